@@ -1,14 +1,26 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"strconv"
-	"sync/atomic"
+	"os"
+	"sync"
 	"time"
 )
 
-var uuidCounter int64
+const (
+	// lockScript sets the lock key if it does not exist yet and returns the
+	// incremented fencing counter.
+	lockScript = "if redis.call('setnx', KEYS[1], ARGV[1]) == 1 then redis.call('pexpire', KEYS[1], ARGV[2]) return redis.call('incr', KEYS[2]) else return 0 end"
+
+	// unlockScript deletes the lock key if it is still held with our value.
+	unlockScript = "if redis.call('get', KEYS[1]) == ARGV[1] then return redis.call('del', KEYS[1]) else return 0 end"
+
+	// extendScript resets the TTL of the lock key, and of any further keys
+	// that belong to the lock, if it is still held with our value.
+	extendScript = "if redis.call('get', KEYS[1]) == ARGV[1] then for i = 2, #KEYS do redis.call('pexpire', KEYS[i], ARGV[2]) end return redis.call('pexpire', KEYS[1], ARGV[2]) else return 0 end"
+)
 
 const (
 	// ClockDriftFactor is the maximum amount of time that a clock can be
@@ -18,6 +30,9 @@ const (
 	// RedisConnectTimeout is the maximum amount of time that the Redlock
 	// algorithm will wait for a connection to a Redis server.
 	RedisConnectTimeout = time.Second
+
+	// defaultValidity is the validity of a lock unless LockOptions set one.
+	defaultValidity = time.Second
 )
 
 // RedisClient is an interface that represents a Redis client.
@@ -45,13 +60,9 @@ type Redlock struct {
 	// algorithm will wait for a connection to a Redis server.
 	RedisConnectTimeout time.Duration
 
-	// retryCount is the number of times that the Redlock algorithm will
-	// try to acquire the lock before giving up.
-	retryCount int
-
-	// retryDelay is the amount of time that the Redlock algorithm will
-	// wait between lock acquisition attempts.
-	retryDelay time.Duration
+	// retry decides whether and when the Redlock algorithm tries to acquire
+	// the lock again after a failed attempt.
+	retry RetryStrategy
 
 	// quorum is the number of Redis servers that must agree on the lock
 	// status in order for the lock to be considered valid.
@@ -60,18 +71,30 @@ type Redlock struct {
 	// servers is a list of Redis servers that the Redlock algorithm will
 	// use to manage the lock.
 	servers []RedisClient
+
+	// forceRelease allows ForceRelease, which reports to audit.
+	forceRelease bool
+	audit        func(ForceReleaseAudit)
+
+	// observer receives the Redlock's events, if set.
+	observer Observer
+
+	// scripts caches the digests of the scripts run on servers that are
+	// ScriptLoaders.
+	scripts *scriptCache
 }
 
 // NewRedlock creates a new Redlock with the given Redis servers and
 // configuration options.
 func NewRedlock(servers []RedisClient, opts ...func(*Redlock)) *Redlock {
+	scripts := newScriptCache(lockScript, unlockScript, extendScript)
 	r := &Redlock{
 		ClockDriftFactor:    ClockDriftFactor,
 		RedisConnectTimeout: RedisConnectTimeout,
-		retryCount:          10,
-		retryDelay:          200 * time.Millisecond,
+		retry:               FixedRetry(10, 200*time.Millisecond),
 		quorum:              len(servers)/2 + 1,
-		servers:             servers,
+		servers:             withScripts(servers, scripts),
+		scripts:             scripts,
 	}
 
 	for _, opt := range opts {
@@ -88,6 +111,31 @@ type LockOptions struct {
 
 	// LockScript is the Redis script used to acquire the lock.
 	LockScript string
+
+	// Owner makes the lock reentrant: acquiring it again with the same
+	// owner while it is held succeeds and must be matched by another
+	// Unlock. Every acquisition is a separate hold that only the Unlock of
+	// its own Lock drops, and re-entry never shortens the TTL of the lock.
+	// Owners should be created with NewOwnerID.
+	Owner string
+
+	// Fair makes waiters take the lock in the order they asked for it
+	// instead of retrying at random. Waiters are woken by the holder's
+	// Unlock on servers that are Notifiers and otherwise retry every third
+	// of the Validity. A fair waiter keeps its place until its context is
+	// done rather than following the RetryStrategy, except that it gives up
+	// once the RetryStrategy does if the context can never be done, as with
+	// Lock. Fair is ignored if Owner is set.
+	Fair bool
+
+	// Metadata appends the acquisition time to the lock value, which then
+	// tells Inspect who holds the lock and since when. Metadata is ignored
+	// if Owner is set, since an owner must keep the same value to re-enter.
+	Metadata bool
+
+	// SafetyMargin is how long before the lock's validity runs out WithLock
+	// cancels the work's context. It defaults to a tenth of Validity.
+	SafetyMargin time.Duration
 }
 
 // Lock is a distributed lock.
@@ -171,62 +219,156 @@ type LockOptions struct {
 
 // Lock attempts to acquire a lock with the given name and options.
 func (r *Redlock) Lock(name string, opts ...func(*LockOptions)) (*Lock, error) {
+	return r.LockContext(context.Background(), name, opts...)
+}
+
+// LockContext attempts to acquire a lock with the given name and options,
+// retrying according to the Redlock's RetryStrategy. It gives up as soon as
+// ctx is done and returns ctx.Err().
+func (r *Redlock) LockContext(ctx context.Context, name string, opts ...func(*LockOptions)) (*Lock, error) {
 	options := &LockOptions{
-		Validity:   time.Second,
-		LockScript: "if redis.call('setnx', KEYS[1], ARGV[1]) == 1 then return redis.call('pexpire', KEYS[1], ARGV[2]) else return 0 end",
+		Validity:   defaultValidity,
+		LockScript: lockScript,
 	}
 
 	for _, opt := range opts {
 		opt(options)
 	}
 
-	uuid := generateUUID()
+	value := generateUUID()
+	switch {
+	case options.Owner != "":
+		value = options.Owner
+	case options.Metadata:
+		value = withMetadata(value, time.Now())
+	}
 	lock := &Lock{
 		Name:      name,
-		Value:     uuid,
+		Value:     value,
 		Validity:  options.Validity,
 		Timestamp: time.Now().UnixNano() / int64(time.Millisecond),
+		reentrant: options.Owner != "",
+		fair:      options.Fair && options.Owner == "",
+	}
+	if lock.reentrant {
+		lock.hold = generateUUID()
 	}
 
-	for i := 0; i < r.retryCount; i++ {
-		startTime := time.Now()
+	if lock.fair {
+		return r.lockFair(ctx, lock, options)
+	}
 
-		n := 0
-		for _, server := range r.servers {
-			ok, err := lockAcquired(server, lock, options)
-			if err != nil {
-				continue
-			}
-			if ok {
-				n++
-			}
-		}
+	return r.acquire(ctx, lock, options.Validity, lockRequest{
+		op: "acquire lock",
+		acquire: func(server RedisClient) (int64, error) {
+			return lockAcquired(server, lock, options)
+		},
+		release: func(server RedisClient) (int64, error) {
+			return lockReleased(server, lock)
+		},
+		fenced: true,
+	})
+}
 
-		if n >= r.quorum {
-			return lock, nil
-		}
+// lockRequest describes how a kind of lock is taken and given back on a
+// single server.
+type lockRequest struct {
+	// op names the request in errors, e.g. "acquire lock".
+	op string
 
-		drift := float64(time.Now().UnixNano()-startTime.UnixNano()) / float64(time.Millisecond) / float64(options.Validity/time.Millisecond)
-		if drift > r.ClockDriftFactor {
-			return nil, errors.New("clock drift is too high")
-		}
+	// acquire and release run the lock's scripts against one server.
+	acquire func(RedisClient) (int64, error)
+	release func(RedisClient) (int64, error)
+
+	// fenced requests issue the lock a fencing token once a quorum voted.
+	fenced bool
+}
 
-		time.Sleep(r.retryDelay)
+// acquire runs quorum rounds of req until one succeeds within the validity
+// of a ttl-long lock, retrying according to the Redlock's RetryStrategy.
+func (r *Redlock) acquire(ctx context.Context, lock *Lock, ttl time.Duration, req lockRequest) (*Lock, error) {
+	err := r.withRetries(ctx, req.op, lock.Name, func() error {
+		return r.tryAcquire(ctx, lock, ttl, req)
+	})
+	if err != nil {
+		return nil, err
 	}
+	return lock, nil
+}
+
+// tryAcquire makes a single attempt at acquiring a ttl-long lock. The keys
+// of a failed attempt are released again.
+func (r *Redlock) tryAcquire(ctx context.Context, lock *Lock, ttl time.Duration, req lockRequest) error {
+	startTime := time.Now()
+
+	votes, n := r.quorumRound(ctx, req.acquire)
+
+	op, results := req.op, votes
+	if n >= r.quorum && req.fenced {
+		lock.Token = highestReply(votes)
+		op = "raise fencing token"
+		results, n = r.raiseFence(ctx, lock)
+	}
+
+	validity, validUntil := r.validity(ttl, startTime)
+	elapsed := time.Since(startTime)
+	r.observeRound(req.op, lock.Name, votes, n >= r.quorum && validity > 0, elapsed)
+
+	if n >= r.quorum && validity > 0 {
+		lock.Validity = validity
+		lock.ValidUntil = validUntil
+		lock.ttl = ttl
+		lock.Votes = votes
+		return nil
+	}
+
+	// Keys set on a minority of servers would otherwise block other
+	// clients until they expire. This must happen even if ctx is done.
+	r.broadcast(context.Background(), req.release)
 
-	return nil, errors.New("unable to acquire lock")
+	if n >= r.quorum {
+		r.observe(ObserverEvent{Kind: DriftAbortEvent, Op: req.op, Name: lock.Name, Elapsed: elapsed})
+		return ErrValidityExpired
+	}
+	return &QuorumError{Op: op, Quorum: r.quorum, Results: results}
 }
 
-func lockAcquired(client RedisClient, lock *Lock, options *LockOptions) (bool, error) {
-	value, err := client.Eval(options.LockScript, []string{lock.Name}, lock.Value, int(options.Validity/time.Millisecond))
-	if err != nil {
-		return false, err
+// withRetries calls attempt until it succeeds, the Redlock's RetryStrategy
+// gives up or ctx is done. It returns the error of the last attempt, or
+// ctx.Err(). op and name describe the attempts to the Observer.
+func (r *Redlock) withRetries(ctx context.Context, op, name string, attempt func() error) error {
+	for attempts := 0; ; {
+		err := attempt()
+		attempts++
+		if err == nil {
+			return nil
+		}
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		delay, retry := r.retry(attempts)
+		if !retry {
+			return err
+		}
+		r.observe(ObserverEvent{Kind: RetryEvent, Op: op, Name: name, Attempt: attempts, Delay: delay})
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
 	}
-	acquired, ok := value.(int64)
-	if !ok {
-		return false, errors.New("invalid response from Redis")
+}
+
+func lockAcquired(client RedisClient, lock *Lock, options *LockOptions) (int64, error) {
+	if lock.reentrant {
+		return evalInt(client, reentrantLockScript, []string{lock.Name, holdsKey(lock.Name), fenceKey(lock.Name)}, lock.Value, int(options.Validity/time.Millisecond), lock.hold)
 	}
-	return acquired == 1, nil
+	return evalInt(client, options.LockScript, []string{lock.Name, fenceKey(lock.Name)}, lock.Value, int(options.Validity/time.Millisecond))
 }
 
 // Lock is a distributed lock.
@@ -237,75 +379,326 @@ type Lock struct {
 	// Value is the value of the lock.
 	Value string
 
-	// Validity is the duration that the lock will be held for.
+	// Validity is the duration that the lock will be held for, measured
+	// from the moment it was acquired.
 	Validity time.Duration
 
+	// ValidUntil is the time at which the lock must be considered lost. It is
+	// the TTL minus the time spent acquiring the lock and the drift allowance.
+	ValidUntil time.Time
+
 	// Timestamp is the timestamp of when the lock was acquired.
 	Timestamp int64
+
+	// Token is the fencing token of the lock. Every successful acquisition
+	// of the same name is issued a larger token than the one before it.
+	// Re-entering a lock held by the same owner does not draw a new token,
+	// but it may report a larger one than the outer hold if a request of the
+	// outer acquisition that the quorum did not wait for bumped the counter
+	// late.
+	Token uint64
+
+	// Votes is the per-server outcome of the round that acquired the lock.
+	Votes []ServerResult
+
+	// ttl is the TTL the lock was requested with.
+	ttl time.Duration
+
+	// reentrant is set for locks acquired with an Owner.
+	reentrant bool
+
+	// hold identifies this acquisition among the holds of a reentrant lock.
+	hold string
+
+	// keys are the keys of a lock on several resources.
+	keys []string
+
+	// fair is set for locks acquired in FIFO order.
+	fair bool
+
+	// reader is set for read locks of a RWRedlock.
+	reader bool
+
+	// intent is the writer intent key of a RWRedlock write lock.
+	intent string
+}
+
+// evalInt runs a script whose reply is an integer.
+func evalInt(client RedisClient, script string, keys []string, args ...interface{}) (int64, error) {
+	value, err := client.Eval(script, keys, args...)
+	if err != nil {
+		return 0, err
+	}
+	reply, ok := value.(int64)
+	if !ok {
+		return 0, errors.New("invalid response from Redis")
+	}
+	return reply, nil
+}
+
+// fenceKey returns the key holding the fencing counter of the named lock.
+func fenceKey(name string) string {
+	return name + ":fence"
+}
+
+// validity returns how long a lock with the given TTL, acquired in a round
+// that started at start, may still be relied on, and until when.
+func (r *Redlock) validity(ttl time.Duration, start time.Time) (time.Duration, time.Time) {
+	// The servers' clocks may run faster than ours, so part of the TTL is
+	// held back as a drift allowance on top of the time already spent.
+	drift := time.Duration(float64(ttl)*r.ClockDriftFactor) + 2*time.Millisecond
+	return ttl - time.Since(start) - drift, start.Add(ttl - drift)
+}
+
+// Remaining returns how much longer the lock is valid for. It is zero or
+// negative once the lock must be considered lost.
+func (l *Lock) Remaining() time.Duration {
+	return time.Until(l.ValidUntil)
 }
 
 // Unlock releases the lock.
 func (r *Redlock) Unlock(lock *Lock) error {
-	n := 0
-	for _, server := range r.servers {
-		ok, err := lockReleased(server, lock)
-		if err != nil {
-			continue
-		}
-		if ok {
-			n++
-		}
+	return r.UnlockContext(context.Background(), lock)
+}
+
+// UnlockContext releases the lock. It stops waiting for the servers as soon
+// as ctx is done and returns ctx.Err().
+func (r *Redlock) UnlockContext(ctx context.Context, lock *Lock) error {
+	err := r.unlock(ctx, lock)
+	if err != nil {
+		r.observe(ObserverEvent{Kind: UnlockFailureEvent, Op: "release lock", Name: lock.Name, Err: err})
+	}
+	return err
+}
+
+func (r *Redlock) unlock(ctx context.Context, lock *Lock) error {
+	startTime := time.Now()
+
+	results, n := r.quorumRound(ctx, func(server RedisClient) (int64, error) {
+		return lockReleased(server, lock)
+	})
+	r.observeRound("release lock", lock.Name, results, n >= r.quorum, time.Since(startTime))
+
+	if lock.fair {
+		r.notifyReleased(lock.Name)
 	}
 
 	if n >= r.quorum {
 		return nil
 	}
 
-	return errors.New("unable to release lock")
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	return &QuorumError{Op: "release lock", Quorum: r.quorum, Results: results}
+}
+
+func lockReleased(client RedisClient, lock *Lock) (int64, error) {
+	if lock.reader {
+		return readLockReleased(client, lock)
+	}
+	if lock.intent != "" {
+		return writeLockReleased(client, lock)
+	}
+	if lock.keys != nil {
+		return evalInt(client, multiUnlockScript, lock.keys, lock.Value)
+	}
+	if lock.reentrant {
+		return evalInt(client, reentrantUnlockScript, []string{lock.Name, holdsKey(lock.Name)}, lock.Value, lock.hold)
+	}
+	return evalInt(client, unlockScript, []string{lock.Name}, lock.Value)
 }
 
-func lockReleased(client RedisClient, lock *Lock) (bool, error) {
-	value, err := client.Eval("if redis.call('get', KEYS[1]) == ARGV[1] then return redis.call('del', KEYS[1]) else return 0 end", []string{lock.Name}, lock.Value)
+// Extend resets the TTL of a held lock to ttl. It only succeeds if a quorum
+// of servers still holds the lock with the lock's value, in which case the
+// lock's Validity and ValidUntil are updated.
+func (r *Redlock) Extend(lock *Lock, ttl time.Duration) error {
+	validity, validUntil, results, err := r.extend(context.Background(), lock, ttl)
 	if err != nil {
-		return false, err
+		return err
 	}
-	released, ok := value.(int64)
-	if !ok {
-		return false, errors.New("invalid response from Redis")
+
+	lock.Validity = validity
+	lock.ValidUntil = validUntil
+	lock.Votes = results
+	lock.ttl = ttl
+	return nil
+}
+
+// extend runs the extend script against all servers without touching lock,
+// so that it can be used from a watchdog while the caller reads the lock. It
+// stops waiting for the servers once ctx is done.
+func (r *Redlock) extend(ctx context.Context, lock *Lock, ttl time.Duration) (time.Duration, time.Time, []ServerResult, error) {
+	startTime := time.Now()
+
+	results, n := r.quorumRound(ctx, func(server RedisClient) (int64, error) {
+		return lockExtended(server, lock, ttl)
+	})
+	validity, validUntil := r.validity(ttl, startTime)
+	r.observeRound("extend lock", lock.Name, results, n >= r.quorum && validity > 0, time.Since(startTime))
+
+	if n < r.quorum {
+		return 0, time.Time{}, results, &QuorumError{Op: "extend lock", Quorum: r.quorum, Results: results}
+	}
+
+	if validity <= 0 {
+		r.observe(ObserverEvent{Kind: DriftAbortEvent, Op: "extend lock", Name: lock.Name, Elapsed: time.Since(startTime)})
+		return 0, time.Time{}, results, ErrValidityExpired
 	}
-	return released == 1, nil
+	return validity, validUntil, results, nil
 }
 
-// generateUUID generates a unique identifier (UUID).
-func generateUUID() string {
-	uuid := atomic.AddInt64(&uuidCounter, 1)
-	return time.Now().Format("20060102150405.000000") + "-" + strconv.FormatInt(uuid, 10)
+func lockExtended(client RedisClient, lock *Lock, ttl time.Duration) (int64, error) {
+	if lock.keys != nil {
+		return evalInt(client, multiExtendScript, lock.keys, lock.Value, int(ttl/time.Millisecond))
+	}
+	keys := []string{lock.Name}
+	if lock.reentrant {
+		keys = append(keys, holdsKey(lock.Name))
+	}
+	return evalInt(client, extendScript, keys, lock.Value, int(ttl/time.Millisecond))
 }
 
-func main() {
-	// Connect to Redis servers.
-	var servers []RedisClient
+// ErrServerTimeout is recorded for a server that did not answer within
+// RedisConnectTimeout.
+var ErrServerTimeout = errors.New("redis server did not answer in time")
 
-	// Create a Redlock instance.
-	redlock := NewRedlock(servers)
+// ErrNotAwaited is recorded for a server whose answer was not waited for
+// because the quorum had already been decided.
+var ErrNotAwaited = errors.New("quorum decided before the server answered")
 
-	// Try to acquire a lock.
-	lock, err := redlock.Lock("my-lock", func(options *LockOptions) {
-		options.Validity = time.Minute
-	})
-	if err != nil {
-		fmt.Println("unable to acquire lock:", err)
-		return
+// ErrValidityExpired is returned when a quorum was reached but acquiring it
+// used up the whole validity of the lock.
+var ErrValidityExpired = errors.New("lock validity expired while acquiring it")
+
+// ServerResult is the outcome of a single Redis server in a quorum round.
+type ServerResult struct {
+	// Server is the index of the server in the Redlock's server list.
+	Server int
+
+	// Voted is true if the server granted the request.
+	Voted bool
+
+	// Reply is the integer the server's script returned. For a granted lock
+	// request it is the server's fencing counter.
+	Reply int64
+
+	// Err is the error returned by the server, if any.
+	Err error
+
+	// Latency is the time the server took to answer.
+	Latency time.Duration
+}
+
+// QuorumError is returned when not enough servers agreed on a request.
+type QuorumError struct {
+	// Op is the operation that failed, e.g. "acquire lock".
+	Op string
+
+	// Quorum is the number of votes that were needed.
+	Quorum int
+
+	// Results is the per-server outcome of the last round.
+	Results []ServerResult
+}
+
+func (e *QuorumError) Error() string {
+	votes := 0
+	for _, result := range e.Results {
+		if result.Voted {
+			votes++
+		}
 	}
-	fmt.Println("lock acquired")
+	return fmt.Sprintf("unable to %s: %d of %d servers agreed, quorum is %d", e.Op, votes, len(e.Results), e.Quorum)
+}
 
-	// Do something with the lock.
-	time.Sleep(time.Second)
+// quorumRound sends op to every server concurrently, bounding each call by
+// RedisConnectTimeout. It returns as soon as a quorum of servers voted for
+// the request, a quorum can no longer be reached or ctx is done, together
+// with the number of votes. Servers that were not waited for are reported
+// with ErrNotAwaited.
+func (r *Redlock) quorumRound(ctx context.Context, op func(RedisClient) (int64, error)) ([]ServerResult, int) {
+	results := make([]ServerResult, len(r.servers))
+	for i := range results {
+		results[i] = ServerResult{Server: i, Err: ErrNotAwaited}
+	}
 
-	// Release the lock.
-	if err := redlock.Unlock(lock); err != nil {
-		fmt.Println("unable to release lock:", err)
-		return
+	// The channel is buffered so that servers answering after the round has
+	// been decided do not leak their goroutines.
+	replies := make(chan ServerResult, len(r.servers))
+	for i, server := range r.servers {
+		go func(i int, server RedisClient) {
+			replies <- r.callServer(ctx, i, server, op)
+		}(i, server)
 	}
-	fmt.Println("lock released")
+
+	votes, failures := 0, 0
+	for range r.servers {
+		if votes >= r.quorum || len(r.servers)-failures < r.quorum {
+			break
+		}
+		var result ServerResult
+		select {
+		case <-ctx.Done():
+			return results, votes
+		case result = <-replies:
+		}
+		results[result.Server] = result
+		if result.Voted {
+			votes++
+		} else {
+			failures++
+		}
+	}
+
+	return results, votes
+}
+
+// broadcast sends op to every server concurrently and waits for all of them,
+// bounding each call by RedisConnectTimeout.
+func (r *Redlock) broadcast(ctx context.Context, op func(RedisClient) (int64, error)) []ServerResult {
+	results := make([]ServerResult, len(r.servers))
+	var wg sync.WaitGroup
+	for i, server := range r.servers {
+		wg.Add(1)
+		go func(i int, server RedisClient) {
+			defer wg.Done()
+			results[i] = r.callServer(ctx, i, server, op)
+		}(i, server)
+	}
+	wg.Wait()
+	return results
+}
+
+// callServer runs op against a single server and gives up after
+// RedisConnectTimeout or once ctx is done.
+func (r *Redlock) callServer(ctx context.Context, i int, server RedisClient, op func(RedisClient) (int64, error)) ServerResult {
+	start := time.Now()
+	done := make(chan ServerResult, 1)
+	go func() {
+		reply, err := op(server)
+		done <- ServerResult{Server: i, Voted: err == nil && reply > 0, Reply: reply, Err: err, Latency: time.Since(start)}
+	}()
+
+	timer := time.NewTimer(r.RedisConnectTimeout)
+	defer timer.Stop()
+
+	select {
+	case result := <-done:
+		return result
+	case <-timer.C:
+		return ServerResult{Server: i, Err: ErrServerTimeout, Latency: time.Since(start)}
+	case <-ctx.Done():
+		return ServerResult{Server: i, Err: ctx.Err(), Latency: time.Since(start)}
+	}
+}
+
+// generateUUID generates a unique identifier (UUID) for a lock value.
+func generateUUID() string {
+	return NewOwnerID()
+}
+
+func main() {
+	os.Exit(runCLI(os.Args[1:], os.Stdout, os.Stderr))
 }
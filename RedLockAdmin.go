@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// inspectScript returns the value and the remaining TTL of KEYS[1].
+const inspectScript = "return {redis.call('get', KEYS[1]), redis.call('pttl', KEYS[1])}"
+
+// ErrForceReleaseDisabled is returned by ForceRelease unless the Redlock was
+// created with WithForceRelease.
+var ErrForceReleaseDisabled = errors.New("force release is disabled")
+
+// ServerState is what a single server knows about a lock.
+type ServerState struct {
+	// Server is the index of the server in the Redlock's server list.
+	Server int
+
+	// Value is the value the lock is held with, or empty if the lock is
+	// not set on the server.
+	Value string
+
+	// TTL is the remaining TTL of the lock on the server's clock. It is
+	// negative for a lock that never expires.
+	TTL time.Duration
+
+	// Err is the error returned by the server, if any.
+	Err error
+}
+
+// LockInfo describes who holds a lock, according to every server.
+type LockInfo struct {
+	// Name is the name of the lock.
+	Name string
+
+	// Servers is the state of the lock on every server.
+	Servers []ServerState
+
+	// Holder is the value the lock is held with on most servers, or empty
+	// if it is free everywhere.
+	Holder string
+
+	// Agree is the number of servers on which the lock is held by Holder.
+	Agree int
+
+	// Quorum is true if enough servers agree on Holder for it to hold the
+	// lock.
+	Quorum bool
+
+	// Metadata is what Holder tells about itself, or nil if it was not
+	// acquired WithMetadata.
+	Metadata *HolderMetadata
+}
+
+// HolderMetadata identifies the process that acquired a lock.
+type HolderMetadata struct {
+	// Host is the hostname of the holder.
+	Host string
+
+	// PID is the process id of the holder.
+	PID int
+
+	// AcquiredAt is the time at which the holder started acquiring the
+	// lock.
+	AcquiredAt time.Time
+}
+
+// ForceReleaseAudit records a ForceRelease.
+type ForceReleaseAudit struct {
+	// Name is the name of the released lock.
+	Name string
+
+	// At is the time of the release.
+	At time.Time
+
+	// Before is the state of the lock just before it was released.
+	Before *LockInfo
+
+	// Results is the per-server outcome of the release.
+	Results []ServerResult
+
+	// Err is the error ForceRelease returned, if any.
+	Err error
+}
+
+// WithForceRelease allows ForceRelease and calls audit for every forced
+// release, whether it succeeded or not.
+func WithForceRelease(audit func(ForceReleaseAudit)) func(*Redlock) {
+	return func(r *Redlock) {
+		r.forceRelease = true
+		r.audit = audit
+	}
+}
+
+// WithMetadata makes the lock value tell who acquired the lock and when, so
+// that Inspect can report it. See LockOptions.Metadata.
+func WithMetadata() func(*LockOptions) {
+	return func(options *LockOptions) {
+		options.Metadata = true
+	}
+}
+
+// Inspect reports the state of a lock on every server. It never changes the
+// lock, so it is safe to call while debugging an incident.
+func (r *Redlock) Inspect(name string) *LockInfo {
+	info := &LockInfo{Name: name, Servers: make([]ServerState, len(r.servers))}
+
+	var wg sync.WaitGroup
+	for i, server := range r.servers {
+		wg.Add(1)
+		go func(i int, server RedisClient) {
+			defer wg.Done()
+			// The server may answer after callServer gave up on it, so the
+			// state is handed over rather than written in place.
+			answered := make(chan ServerState, 1)
+			result := r.callServer(context.Background(), i, server, func(server RedisClient) (int64, error) {
+				value, ttl, err := inspect(server, name)
+				answered <- ServerState{Value: value, TTL: ttl}
+				return 1, err
+			})
+
+			state := ServerState{Err: result.Err}
+			if result.Err == nil {
+				state = <-answered
+			}
+			state.Server = i
+			info.Servers[i] = state
+		}(i, server)
+	}
+	wg.Wait()
+
+	counts := make(map[string]int)
+	for _, state := range info.Servers {
+		if state.Value == "" {
+			continue
+		}
+		counts[state.Value]++
+		if counts[state.Value] > info.Agree {
+			info.Holder, info.Agree = state.Value, counts[state.Value]
+		}
+	}
+	info.Quorum = info.Agree >= r.quorum
+	if metadata, ok := ParseHolder(info.Holder); ok {
+		info.Metadata = &metadata
+	}
+	return info
+}
+
+// ForceRelease deletes a lock on every server regardless of who holds it.
+// It is meant for operators recovering from an incident: the holder is not
+// told and may still be working under the lock. It returns
+// ErrForceReleaseDisabled unless the Redlock was created with
+// WithForceRelease.
+func (r *Redlock) ForceRelease(name string) error {
+	if !r.forceRelease {
+		return ErrForceReleaseDisabled
+	}
+
+	audit := ForceReleaseAudit{Name: name, At: time.Now(), Before: r.Inspect(name)}
+	audit.Results = r.broadcast(context.Background(), func(server RedisClient) (int64, error) {
+		for _, key := range []string{name, holdsKey(name)} {
+			if err := server.Del(key); err != nil {
+				return 0, err
+			}
+		}
+		return 1, nil
+	})
+
+	n := 0
+	for _, result := range audit.Results {
+		if result.Voted {
+			n++
+		}
+	}
+	if n < r.quorum {
+		audit.Err = &QuorumError{Op: "force release lock", Quorum: r.quorum, Results: audit.Results}
+	}
+
+	if r.audit != nil {
+		r.audit(audit)
+	}
+	return audit.Err
+}
+
+// ParseHolder extracts the metadata from a lock value of the form
+// host:pid:random@millis that a lock acquired WithMetadata is held with.
+func ParseHolder(value string) (HolderMetadata, bool) {
+	at := strings.LastIndexByte(value, '@')
+	if at < 0 {
+		return HolderMetadata{}, false
+	}
+	millis, err := strconv.ParseInt(value[at+1:], 10, 64)
+	if err != nil {
+		return HolderMetadata{}, false
+	}
+
+	parts := strings.Split(value[:at], ":")
+	if len(parts) < 3 {
+		return HolderMetadata{}, false
+	}
+	pid, err := strconv.Atoi(parts[len(parts)-2])
+	if err != nil {
+		return HolderMetadata{}, false
+	}
+
+	return HolderMetadata{
+		Host:       strings.Join(parts[:len(parts)-2], ":"),
+		PID:        pid,
+		AcquiredAt: time.Unix(0, millis*int64(time.Millisecond)),
+	}, true
+}
+
+// withMetadata appends the acquisition time to an owner ID.
+func withMetadata(id string, at time.Time) string {
+	return fmt.Sprintf("%s@%d", id, at.UnixNano()/int64(time.Millisecond))
+}
+
+// inspect reads the value and the remaining TTL of a lock from one server.
+func inspect(server RedisClient, name string) (string, time.Duration, error) {
+	reply, err := server.Eval(inspectScript, []string{name})
+	if err != nil {
+		return "", 0, err
+	}
+
+	fields, ok := reply.([]interface{})
+	if !ok || len(fields) != 2 {
+		return "", 0, fmt.Errorf("unexpected reply %v to inspect script", reply)
+	}
+	value, _ := fields[0].(string)
+	pttl, ok := fields[1].(int64)
+	if !ok {
+		return "", 0, fmt.Errorf("unexpected TTL %v in reply to inspect script", fields[1])
+	}
+
+	switch pttl {
+	case -2:
+		return "", 0, nil
+	case -1:
+		return value, -1, nil
+	}
+	return value, time.Duration(pttl) * time.Millisecond, nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestInspect(t *testing.T) {
+	redlock, fakes := newTestRedlock(3)
+
+	before := time.Now().Add(-time.Millisecond)
+	lock, err := redlock.Lock("my-lock", withValidity(time.Minute), WithMetadata())
+	if err != nil {
+		t.Fatalf("Lock: %v", err)
+	}
+	fakes[2].Set("my-lock", "someone-else", 0)
+	fakes[1].SetError(errors.New("boom"))
+
+	info := redlock.Inspect("my-lock")
+	if info.Holder != lock.Value || info.Agree != 1 || info.Quorum {
+		t.Fatalf("Inspect = holder %q on %d servers, quorum %v; want %q on 1 without quorum",
+			info.Holder, info.Agree, info.Quorum, lock.Value)
+	}
+	if state := info.Servers[0]; state.Value != lock.Value || state.TTL <= 50*time.Second || state.TTL > time.Minute {
+		t.Fatalf("server 0 reports %q with TTL %v", state.Value, state.TTL)
+	}
+	if state := info.Servers[1]; state.Err == nil {
+		t.Fatalf("server 1 reports no error")
+	}
+	if state := info.Servers[2]; state.Value != "someone-else" || state.TTL >= 0 {
+		t.Fatalf("server 2 reports %q with TTL %v, want a lock without TTL", state.Value, state.TTL)
+	}
+
+	host, _ := os.Hostname()
+	metadata := info.Metadata
+	if metadata == nil {
+		t.Fatalf("Inspect found no metadata in %q", info.Holder)
+	}
+	if metadata.Host != host || metadata.PID != os.Getpid() {
+		t.Fatalf("metadata names %s:%d, want %s:%d", metadata.Host, metadata.PID, host, os.Getpid())
+	}
+	if metadata.AcquiredAt.Before(before) || metadata.AcquiredAt.After(time.Now()) {
+		t.Fatalf("metadata says acquired at %v", metadata.AcquiredAt)
+	}
+
+	fakes[1].SetError(nil)
+	if info := redlock.Inspect("my-lock"); info.Agree != 2 || !info.Quorum {
+		t.Fatalf("Inspect with all servers up = %d agreeing, quorum %v", info.Agree, info.Quorum)
+	}
+}
+
+func TestForceRelease(t *testing.T) {
+	redlock, _ := newTestRedlock(3)
+	lock, err := redlock.Lock("my-lock", withValidity(time.Minute))
+	if err != nil {
+		t.Fatalf("Lock: %v", err)
+	}
+	if err := redlock.ForceRelease("my-lock"); err != ErrForceReleaseDisabled {
+		t.Fatalf("ForceRelease without WithForceRelease = %v, want %v", err, ErrForceReleaseDisabled)
+	}
+
+	var audits []ForceReleaseAudit
+	admin := NewRedlock(redlock.servers, WithForceRelease(func(audit ForceReleaseAudit) {
+		audits = append(audits, audit)
+	}))
+	if err := admin.ForceRelease("my-lock"); err != nil {
+		t.Fatalf("ForceRelease: %v", err)
+	}
+	if len(audits) != 1 || audits[0].Before.Holder != lock.Value || audits[0].Err != nil {
+		t.Fatalf("audit = %+v, want one successful release of %q", audits, lock.Value)
+	}
+	if info := redlock.Inspect("my-lock"); info.Holder != "" {
+		t.Fatalf("lock still held by %q after ForceRelease", info.Holder)
+	}
+	if _, err := redlock.Lock("my-lock"); err != nil {
+		t.Fatalf("Lock after ForceRelease: %v", err)
+	}
+}
+
+func TestParseHolder(t *testing.T) {
+	at := time.Unix(1700000000, 0)
+	metadata, ok := ParseHolder(withMetadata("db-1:42:0123abcd", at))
+	if !ok || metadata.Host != "db-1" || metadata.PID != 42 || !metadata.AcquiredAt.Equal(at) {
+		t.Fatalf("ParseHolder = %+v, %v", metadata, ok)
+	}
+
+	for _, value := range []string{"", "db-1:42:0123abcd", "random@123", "db-1:x:0123abcd@123"} {
+		if _, ok := ParseHolder(value); ok {
+			t.Fatalf("ParseHolder(%q) succeeded", value)
+		}
+	}
+}
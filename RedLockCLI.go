@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Exit codes of the redlock command. Contention and quorum loss follow
+// sysexits.h, so that cron jobs can tell "try again later" from "the lock
+// service is down".
+const (
+	exitOK    = 0
+	exitError = 1
+	exitUsage = 2
+
+	// exitNoQuorum means too few servers answered (EX_UNAVAILABLE).
+	exitNoQuorum = 69
+
+	// exitLockLost means the lock was lost while it was held (EX_IOERR).
+	exitLockLost = 74
+
+	// exitContention means the lock is held by someone else (EX_TEMPFAIL).
+	exitContention = 75
+)
+
+const cliUsage = `usage: redlock [flags] <command> [args]
+
+commands:
+  acquire [-ttl d] NAME           acquire the lock and print VALUE TOKEN
+  hold [-ttl d] -for d NAME       hold the lock, renewing it, for d or until interrupted
+  release NAME VALUE              release a lock taken with acquire
+  extend [-ttl d] NAME VALUE      reset the TTL of a lock taken with acquire
+  inspect NAME                    show the state of the lock on every server
+  exec [-ttl d] NAME -- CMD...    run CMD while holding and renewing the lock
+
+exit status:
+  0   success
+  1   error
+  2   usage error
+  69  too few servers answered to reach a quorum
+  74  the lock was lost while it was held
+  75  the lock is held by someone else (for release and extend: not by VALUE)
+  exec otherwise exits with the status of CMD.
+
+flags:
+`
+
+// cli runs the redlock command.
+type cli struct {
+	stdout, stderr io.Writer
+
+	// dial connects to the servers at addrs.
+	dial func(addrs []string, timeout time.Duration) []RedisClient
+}
+
+// runCLI runs the redlock command with args and returns its exit code.
+func runCLI(args []string, stdout, stderr io.Writer) int {
+	c := &cli{stdout: stdout, stderr: stderr, dial: NewGoRedisClients}
+	return c.run(args)
+}
+
+func (c *cli) run(args []string) int {
+	flags := flag.NewFlagSet("redlock", flag.ContinueOnError)
+	flags.SetOutput(c.stderr)
+	servers := flags.String("servers", os.Getenv("REDLOCK_SERVERS"), "comma-separated `host:port` list of Redis servers (default $REDLOCK_SERVERS)")
+	timeout := flags.Duration("timeout", RedisConnectTimeout, "per-server request timeout")
+	retries := flags.Int("retries", 1, "number of attempts at acquiring the lock")
+	retryDelay := flags.Duration("retry-delay", 200*time.Millisecond, "delay between attempts")
+	flags.Usage = func() {
+		fmt.Fprint(c.stderr, cliUsage)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return exitUsage
+	}
+	if flags.NArg() == 0 || *servers == "" {
+		flags.Usage()
+		return exitUsage
+	}
+
+	addrs := strings.Split(*servers, ",")
+	redlock := NewRedlock(c.dial(addrs, *timeout),
+		WithRetryStrategy(FixedRetry(*retries, *retryDelay)),
+		func(r *Redlock) { r.RedisConnectTimeout = *timeout })
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	command, args := flags.Arg(0), flags.Args()[1:]
+	switch command {
+	case "acquire":
+		return c.acquire(ctx, redlock, args)
+	case "hold":
+		return c.hold(ctx, redlock, args)
+	case "release":
+		return c.release(redlock, args)
+	case "extend":
+		return c.extend(redlock, args)
+	case "inspect":
+		return c.inspect(redlock, addrs, args)
+	case "exec":
+		return c.exec(ctx, redlock, args)
+	}
+	fmt.Fprintf(c.stderr, "redlock: unknown command %q\n", command)
+	flags.Usage()
+	return exitUsage
+}
+
+func (c *cli) acquire(ctx context.Context, redlock *Redlock, args []string) int {
+	flags, ttl := c.commandFlags("acquire")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 1 {
+		return c.usage(flags, "acquire [-ttl d] NAME")
+	}
+
+	lock, err := redlock.LockContext(ctx, flags.Arg(0), WithMetadata(), withTTL(*ttl))
+	if err != nil {
+		return c.fail("acquire", err)
+	}
+	fmt.Fprintf(c.stdout, "%s %d\n", lock.Value, lock.Token)
+	return exitOK
+}
+
+func (c *cli) hold(ctx context.Context, redlock *Redlock, args []string) int {
+	flags, ttl := c.commandFlags("hold")
+	duration := flags.Duration("for", 0, "how long to hold the lock (default: until interrupted)")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 1 {
+		return c.usage(flags, "hold [-ttl d] -for d NAME")
+	}
+
+	err := redlock.WithLock(ctx, flags.Arg(0), func(ctx context.Context) error {
+		if *duration > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, *duration)
+			defer cancel()
+		}
+		<-ctx.Done()
+		return nil
+	}, WithMetadata(), withTTL(*ttl))
+	if err != nil {
+		return c.fail("hold", err)
+	}
+	return exitOK
+}
+
+func (c *cli) release(redlock *Redlock, args []string) int {
+	flags := flag.NewFlagSet("release", flag.ContinueOnError)
+	flags.SetOutput(c.stderr)
+	if err := flags.Parse(args); err != nil || flags.NArg() != 2 {
+		return c.usage(flags, "release NAME VALUE")
+	}
+
+	if err := redlock.Unlock(&Lock{Name: flags.Arg(0), Value: flags.Arg(1)}); err != nil {
+		return c.fail("release", err)
+	}
+	return exitOK
+}
+
+func (c *cli) extend(redlock *Redlock, args []string) int {
+	flags, ttl := c.commandFlags("extend")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 2 {
+		return c.usage(flags, "extend [-ttl d] NAME VALUE")
+	}
+
+	if err := redlock.Extend(&Lock{Name: flags.Arg(0), Value: flags.Arg(1)}, *ttl); err != nil {
+		return c.fail("extend", err)
+	}
+	return exitOK
+}
+
+func (c *cli) inspect(redlock *Redlock, addrs []string, args []string) int {
+	flags := flag.NewFlagSet("inspect", flag.ContinueOnError)
+	flags.SetOutput(c.stderr)
+	if err := flags.Parse(args); err != nil || flags.NArg() != 1 {
+		return c.usage(flags, "inspect NAME")
+	}
+
+	info := redlock.Inspect(flags.Arg(0))
+	for i, state := range info.Servers {
+		switch {
+		case state.Err != nil:
+			fmt.Fprintf(c.stdout, "%s: error: %v\n", addrs[i], state.Err)
+		case state.Value == "":
+			fmt.Fprintf(c.stdout, "%s: free\n", addrs[i])
+		case state.TTL < 0:
+			fmt.Fprintf(c.stdout, "%s: %s, no TTL\n", addrs[i], state.Value)
+		default:
+			fmt.Fprintf(c.stdout, "%s: %s, expires in %v\n", addrs[i], state.Value, state.TTL)
+		}
+	}
+
+	if info.Holder == "" {
+		fmt.Fprintln(c.stdout, "holder: none")
+		return exitOK
+	}
+	quorum := "no quorum"
+	if info.Quorum {
+		quorum = "quorum"
+	}
+	fmt.Fprintf(c.stdout, "holder: %s on %d of %d servers (%s)\n", info.Holder, info.Agree, len(info.Servers), quorum)
+	if metadata := info.Metadata; metadata != nil {
+		fmt.Fprintf(c.stdout, "acquired by pid %d on %s at %s\n", metadata.PID, metadata.Host, metadata.AcquiredAt.Format(time.RFC3339Nano))
+	}
+	return exitOK
+}
+
+func (c *cli) exec(ctx context.Context, redlock *Redlock, args []string) int {
+	flags, ttl := c.commandFlags("exec")
+	if err := flags.Parse(args); err != nil || flags.NArg() < 2 {
+		return c.usage(flags, "exec [-ttl d] NAME -- CMD [ARGS...]")
+	}
+	name, command := flags.Arg(0), flags.Args()[1:]
+	if command[0] == "--" {
+		command = command[1:]
+	}
+	if len(command) == 0 {
+		return c.usage(flags, "exec [-ttl d] NAME -- CMD [ARGS...]")
+	}
+
+	status := exitOK
+	err := redlock.WithLock(ctx, name, func(ctx context.Context) error {
+		cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, c.stdout, c.stderr
+		err := cmd.Run()
+
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && ctx.Err() == nil {
+			status = exitErr.ExitCode()
+			return nil
+		}
+		return err
+	}, WithMetadata(), withTTL(*ttl))
+	if err != nil {
+		return c.fail("exec", err)
+	}
+	return status
+}
+
+// commandFlags returns the flags of a command that acquires or extends a
+// lock.
+func (c *cli) commandFlags(name string) (*flag.FlagSet, *time.Duration) {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(c.stderr)
+	ttl := flags.Duration("ttl", 30*time.Second, "TTL of the lock")
+	return flags, ttl
+}
+
+func (c *cli) usage(flags *flag.FlagSet, synopsis string) int {
+	fmt.Fprintf(c.stderr, "usage: redlock %s\n", synopsis)
+	flags.PrintDefaults()
+	return exitUsage
+}
+
+// fail reports err and returns the exit code that classifies it.
+func (c *cli) fail(command string, err error) int {
+	fmt.Fprintf(c.stderr, "redlock %s: %v\n", command, err)
+
+	var quorumErr *QuorumError
+	switch {
+	case errors.Is(err, ErrLockLost):
+		return exitLockLost
+	case errors.As(err, &quorumErr):
+		// A server that answered but did not vote has the lock set to a
+		// different value; otherwise too few servers answered at all.
+		for _, result := range quorumErr.Results {
+			if result.Err == nil && !result.Voted {
+				return exitContention
+			}
+		}
+		return exitNoQuorum
+	}
+	return exitError
+}
+
+func withTTL(ttl time.Duration) func(*LockOptions) {
+	return func(options *LockOptions) {
+		options.Validity = ttl
+	}
+}
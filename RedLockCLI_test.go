@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestCLI creates a cli that talks to three fake servers.
+func newTestCLI() (*cli, []*FakeRedis, *bytes.Buffer) {
+	fakes, servers := NewFakeCluster(3)
+	var stdout bytes.Buffer
+	c := &cli{
+		stdout: &stdout,
+		stderr: &bytes.Buffer{},
+		dial: func(addrs []string, timeout time.Duration) []RedisClient {
+			return servers
+		},
+	}
+	return c, fakes, &stdout
+}
+
+func cliArgs(args ...string) []string {
+	return append([]string{"-servers", "a:6379,b:6379,c:6379", "-timeout", "100ms"}, args...)
+}
+
+func TestCLIAcquireRelease(t *testing.T) {
+	c, _, stdout := newTestCLI()
+
+	if code := c.run(cliArgs("acquire", "-ttl", "1m", "cron")); code != exitOK {
+		t.Fatalf("acquire exited with %d", code)
+	}
+	fields := strings.Fields(stdout.String())
+	if len(fields) != 2 || fields[1] != "1" {
+		t.Fatalf("acquire printed %q, want VALUE TOKEN", stdout.String())
+	}
+	value := fields[0]
+
+	if code := c.run(cliArgs("acquire", "cron")); code != exitContention {
+		t.Fatalf("acquire of a held lock exited with %d, want %d", code, exitContention)
+	}
+	if code := c.run(cliArgs("extend", "-ttl", "2m", "cron", value)); code != exitOK {
+		t.Fatalf("extend exited with %d", code)
+	}
+
+	stdout.Reset()
+	if code := c.run(cliArgs("inspect", "cron")); code != exitOK {
+		t.Fatalf("inspect exited with %d", code)
+	}
+	if !strings.Contains(stdout.String(), "holder: "+value+" on 3 of 3 servers (quorum)") {
+		t.Fatalf("inspect printed:\n%s", stdout.String())
+	}
+	if !strings.Contains(stdout.String(), "acquired by pid ") {
+		t.Fatalf("inspect printed no holder metadata:\n%s", stdout.String())
+	}
+
+	if code := c.run(cliArgs("release", "cron", "someone-else")); code != exitContention {
+		t.Fatalf("release with the wrong value exited with %d, want %d", code, exitContention)
+	}
+	if code := c.run(cliArgs("release", "cron", value)); code != exitOK {
+		t.Fatalf("release exited with %d", code)
+	}
+	if code := c.run(cliArgs("acquire", "cron")); code != exitOK {
+		t.Fatalf("acquire after release exited with %d", code)
+	}
+}
+
+func TestCLIQuorumLoss(t *testing.T) {
+	c, fakes, _ := newTestCLI()
+	for _, fake := range fakes[:2] {
+		fake.Crash(false)
+	}
+
+	if code := c.run(cliArgs("acquire", "cron")); code != exitNoQuorum {
+		t.Fatalf("acquire with 1 of 3 servers up exited with %d, want %d", code, exitNoQuorum)
+	}
+}
+
+func TestCLIUsage(t *testing.T) {
+	c, _, _ := newTestCLI()
+
+	for _, args := range [][]string{
+		{"acquire", "cron"},
+		cliArgs(),
+		cliArgs("steal", "cron"),
+		cliArgs("release", "cron"),
+		cliArgs("exec", "cron", "--"),
+	} {
+		if code := c.run(args); code != exitUsage {
+			t.Fatalf("redlock %q exited with %d, want %d", args, code, exitUsage)
+		}
+	}
+}
+
+func TestCLIHold(t *testing.T) {
+	c, _, _ := newTestCLI()
+
+	if code := c.run(cliArgs("hold", "-ttl", "60ms", "-for", "150ms", "cron")); code != exitOK {
+		t.Fatalf("hold exited with %d", code)
+	}
+	if code := c.run(cliArgs("acquire", "cron")); code != exitOK {
+		t.Fatalf("hold did not release the lock: acquire exited with %d", code)
+	}
+}
+
+func TestCLIExec(t *testing.T) {
+	c, fakes, stdout := newTestCLI()
+
+	if code := c.run(cliArgs("exec", "cron", "--", "echo", "hello")); code != exitOK {
+		t.Fatalf("exec exited with %d", code)
+	}
+	if stdout.String() != "hello\n" {
+		t.Fatalf("exec printed %q", stdout.String())
+	}
+	if code := c.run(cliArgs("exec", "cron", "--", "sh", "-c", "exit 3")); code != 3 {
+		t.Fatalf("exec of a failing command exited with %d, want 3", code)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		for _, fake := range fakes[:2] {
+			fake.SetError(errors.New("boom"))
+		}
+	}()
+	start := time.Now()
+	if code := c.run(cliArgs("exec", "-ttl", "60ms", "cron", "--", "sleep", "5")); code != exitLockLost {
+		t.Fatalf("exec that lost the lock exited with %d, want %d", code, exitLockLost)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("command kept running for %v after the lock was lost", elapsed)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCheckSafetyWithoutFaults(t *testing.T) {
+	report := CheckSafety(SafetyConfig{
+		Servers: 3,
+		Clients: 4,
+		Rounds:  5,
+		TTL:     200 * time.Millisecond,
+		Work:    2 * time.Millisecond,
+		Seed:    1,
+	})
+
+	if report.Violation != nil {
+		t.Fatalf("unexpected violation without faults:\n%v", report.Violation)
+	}
+	if holds := holdsOf(report.History); len(holds) != 20 {
+		t.Fatalf("got %d holds, want every client to acquire the lock every round", len(holds))
+	}
+}
+
+func TestCheckSafetyFindsPausedHolder(t *testing.T) {
+	report := CheckSafety(SafetyConfig{
+		Servers:          3,
+		Clients:          2,
+		Rounds:           2,
+		TTL:              40 * time.Millisecond,
+		Work:             time.Millisecond,
+		PauseProbability: 1,
+		Pause:            120 * time.Millisecond,
+		Seed:             1,
+	})
+
+	violation := report.Violation
+	if violation == nil {
+		t.Fatalf("no violation although every holder pauses for longer than the TTL")
+	}
+	t.Logf("counterexample:\n%v", violation)
+
+	if violation.First.Client == violation.Second.Client {
+		t.Fatalf("violation between a client and itself: %+v", violation)
+	}
+	if violation.Second.Token <= violation.First.Token {
+		t.Fatalf("later holder has token %d, want more than %d", violation.Second.Token, violation.First.Token)
+	}
+}
+
+func TestCheckSafetyPersistentRestarts(t *testing.T) {
+	report := CheckSafety(SafetyConfig{
+		Servers:       3,
+		Clients:       3,
+		Rounds:        5,
+		TTL:           200 * time.Millisecond,
+		Work:          5 * time.Millisecond,
+		FaultInterval: 5 * time.Millisecond,
+		Restarts:      true,
+		Persist:       true,
+		Seed:          1,
+	})
+
+	if report.Violation != nil {
+		t.Fatalf("restarts that keep their keys broke mutual exclusion:\n%v", report.Violation)
+	}
+	restarts := 0
+	for _, event := range report.History {
+		if event.Kind == EventRestart {
+			restarts++
+		}
+	}
+	if restarts == 0 {
+		t.Fatalf("no restarts were injected")
+	}
+}
+
+func TestFindViolationTrace(t *testing.T) {
+	ms := time.Millisecond
+	history := []HistoryEvent{
+		{At: 0 * ms, Kind: EventAcquire, Client: 0, Server: -1, Token: 1},
+		{At: 5 * ms, Kind: EventRelease, Client: 0, Server: -1, Token: 1},
+		{At: 6 * ms, Kind: EventAcquire, Client: 1, Server: -1, Token: 2},
+		{At: 7 * ms, Kind: EventRestart, Client: -1, Server: 2},
+		{At: 8 * ms, Kind: EventAcquire, Client: 2, Server: -1, Token: 3},
+		{At: 9 * ms, Kind: EventAcquire, Client: 0, Server: -1, Token: 4},
+		{At: 10 * ms, Kind: EventRelease, Client: 1, Server: -1, Token: 2},
+		{At: 11 * ms, Kind: EventRelease, Client: 2, Server: -1, Token: 3},
+	}
+
+	violation := FindViolation(history)
+	if violation == nil {
+		t.Fatalf("FindViolation missed the overlap of clients 1 and 2")
+	}
+	if violation.First.Client != 1 || violation.Second.Client != 2 {
+		t.Fatalf("got overlap of clients %d and %d, want 1 and 2", violation.First.Client, violation.Second.Client)
+	}
+	// The trace covers 6ms..10ms and leaves out client 0.
+	if len(violation.Trace) != 4 {
+		t.Fatalf("trace has %d events, want 4:\n%v", len(violation.Trace), violation)
+	}
+
+	if FindViolation(history[:4]) != nil {
+		t.Fatalf("FindViolation reported a violation for sequential holds")
+	}
+}
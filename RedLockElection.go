@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrNoLeader is returned by Election.Leader while no candidate holds the
+// leadership on a quorum of servers.
+var ErrNoLeader = errors.New("no leader elected")
+
+// ErrElectionTTL is returned by Election.Campaign for an election without a
+// positive TTL.
+var ErrElectionTTL = errors.New("election TTL must be positive")
+
+// Leadership identifies a leader and its term.
+type Leadership struct {
+	// Identity is the identity of the leader, or empty if there is none.
+	Identity string
+
+	// Term is the leader's term. Every leader is elected with a larger term
+	// than the ones before it, so a follower that sees requests from an
+	// older term knows they come from a stale leader.
+	Term uint64
+}
+
+// Election elects one leader among the candidates campaigning for the same
+// name. The leadership is a Redlock that a Watchdog keeps alive, and the
+// term is its fencing token.
+type Election struct {
+	r *Redlock
+
+	// Name is the name of the election.
+	Name string
+
+	// Identity identifies this candidate to the others. It defaults to a
+	// fresh owner ID and must be unique among the candidates.
+	Identity string
+
+	// TTL is the validity of the leadership. A leader that dies is replaced
+	// within about TTL.
+	TTL time.Duration
+
+	mu       sync.Mutex
+	lock     *Lock
+	watchdog *Watchdog
+
+	// stale are lost leaderships whose locks could not be released. Being
+	// reentrant, they would otherwise keep the key held past a Resign.
+	stale []*Lock
+
+	// observers are woken whenever this candidate gains or loses the
+	// leadership.
+	observers map[chan struct{}]struct{}
+}
+
+// NewElection creates a candidate for the election called name whose
+// leadership is valid for ttl.
+func NewElection(r *Redlock, name string, ttl time.Duration) *Election {
+	return &Election{
+		r:         r,
+		Name:      name,
+		Identity:  NewOwnerID(),
+		TTL:       ttl,
+		observers: make(map[chan struct{}]struct{}),
+	}
+}
+
+// Campaign blocks until the candidate is elected leader or ctx is done, in
+// which case it returns ctx.Err(). It returns immediately if the candidate
+// already leads. Once elected, the leadership is renewed in the background
+// until Resign is called or a renewal fails; Context tells when that
+// happens. It returns ErrElectionTTL if the TTL is not positive.
+func (e *Election) Campaign(ctx context.Context) error {
+	if e.TTL <= 0 {
+		return fmt.Errorf("%w: %v", ErrElectionTTL, e.TTL)
+	}
+	if e.Term() != 0 {
+		return nil
+	}
+
+	for {
+		lock, err := e.r.LockContext(ctx, e.Name, WithOwner(e.Identity), func(options *LockOptions) {
+			options.Validity = e.TTL
+		})
+		if err == nil {
+			e.lead(lock)
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		timer := time.NewTimer(e.TTL / 3)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// lead starts keeping lock alive and watches for its loss.
+func (e *Election) lead(lock *Lock) {
+	watchdog := e.r.KeepAlive(lock)
+
+	e.mu.Lock()
+	e.lock, e.watchdog = lock, watchdog
+	e.mu.Unlock()
+	e.notify()
+
+	go func() {
+		<-watchdog.Done()
+
+		// A failed renewal can leave the lock held on some servers, where a
+		// later Campaign would re-enter it. Resign releases the lock itself.
+		released := watchdog.Err() == nil || e.r.Unlock(lock) == nil
+
+		e.mu.Lock()
+		lost := e.watchdog == watchdog
+		if lost {
+			e.lock, e.watchdog = nil, nil
+		}
+		if !released {
+			e.stale = append(e.stale, lock)
+		}
+		e.mu.Unlock()
+
+		if lost {
+			e.notify()
+		}
+	}()
+}
+
+// Resign gives up the leadership so that another candidate can be elected
+// right away. It also drops what is left of earlier leaderships that were
+// lost, and otherwise does nothing if the candidate does not lead.
+func (e *Election) Resign() error {
+	e.mu.Lock()
+	lock, watchdog, stale := e.lock, e.watchdog, e.stale
+	e.lock, e.watchdog, e.stale = nil, nil, nil
+	e.mu.Unlock()
+
+	// The stale locks may have expired on every server by now, so failing
+	// to release them is not an error.
+	for _, lost := range stale {
+		_ = e.r.Unlock(lost)
+	}
+
+	if lock == nil {
+		return nil
+	}
+
+	watchdog.Stop()
+	err := e.r.Unlock(lock)
+	e.notify()
+	return err
+}
+
+// Term returns the candidate's term while it leads, and zero otherwise. A
+// candidate stops leading the moment its leadership's validity runs out.
+func (e *Election) Term() uint64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.lock == nil || e.watchdog.Context().Err() != nil || !time.Now().Before(e.watchdog.ValidUntil()) {
+		return 0
+	}
+	return e.lock.Token
+}
+
+// Context returns a context that is cancelled when the candidate stops
+// leading, at the latest when the validity of its leadership runs out.
+// Leaders should do their work under it. If the candidate does
+// not lead, the context is already cancelled.
+func (e *Election) Context() context.Context {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.watchdog == nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		return ctx
+	}
+	return e.watchdog.Context()
+}
+
+// Leader returns the current leader according to a quorum of servers. Its
+// term is the highest fencing counter a quorum of servers has reached,
+// which is the leader's token: candidates that failed to get elected can
+// only have raised the counter on a minority.
+func (e *Election) Leader() (Leadership, error) {
+	info := e.r.Inspect(e.Name)
+	if !info.Quorum {
+		return Leadership{}, ErrNoLeader
+	}
+
+	var terms []uint64
+	for _, value := range e.r.values(fenceKey(e.Name)) {
+		term, err := strconv.ParseUint(value, 10, 64)
+		if err == nil {
+			terms = append(terms, term)
+		}
+	}
+	if len(terms) < e.r.quorum {
+		return Leadership{}, ErrNoLeader
+	}
+	sort.Slice(terms, func(i, j int) bool { return terms[i] > terms[j] })
+
+	return Leadership{Identity: info.Holder, Term: terms[e.r.quorum-1]}, nil
+}
+
+// Observe returns a channel that receives the current leadership and then
+// every change of it, with a zero Leadership while there is no leader.
+// Changes made by this candidate are reported right away; others are
+// noticed by polling every third of the TTL. The channel is closed once ctx
+// is done.
+func (e *Election) Observe(ctx context.Context) <-chan Leadership {
+	changes := make(chan Leadership)
+	wake := make(chan struct{}, 1)
+
+	e.mu.Lock()
+	e.observers[wake] = struct{}{}
+	e.mu.Unlock()
+
+	go func() {
+		defer close(changes)
+		defer func() {
+			e.mu.Lock()
+			delete(e.observers, wake)
+			e.mu.Unlock()
+		}()
+
+		var last Leadership
+		first := true
+		for {
+			// ErrNoLeader is reported as the zero Leadership.
+			current, _ := e.Leader()
+			if first || current != last {
+				select {
+				case changes <- current:
+				case <-ctx.Done():
+					return
+				}
+				last, first = current, false
+			}
+
+			timer := time.NewTimer(e.TTL / 3)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-wake:
+			case <-timer.C:
+			}
+			timer.Stop()
+		}
+	}()
+
+	return changes
+}
+
+// notify wakes the observers of this candidate.
+func (e *Election) notify() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for wake := range e.observers {
+		select {
+		case wake <- struct{}{}:
+		default:
+		}
+	}
+}
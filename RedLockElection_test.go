@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestElection(t *testing.T) {
+	redlock, _ := newTestRedlock(3)
+	alice := NewElection(redlock, "scheduler", time.Second)
+	bob := NewElection(redlock, "scheduler", time.Second)
+
+	if _, err := alice.Leader(); err != ErrNoLeader {
+		t.Fatalf("Leader before any campaign = %v, want %v", err, ErrNoLeader)
+	}
+	if err := alice.Campaign(context.Background()); err != nil {
+		t.Fatalf("Campaign(alice): %v", err)
+	}
+	leader, err := bob.Leader()
+	if err != nil || leader.Identity != alice.Identity || leader.Term != alice.Term() {
+		t.Fatalf("Leader = %+v, %v; want alice in term %d", leader, err, alice.Term())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := bob.Campaign(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Campaign(bob) while alice leads = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	if err := alice.Resign(); err != nil {
+		t.Fatalf("Resign: %v", err)
+	}
+	if alice.Context().Err() == nil {
+		t.Fatalf("alice's context is alive after resigning")
+	}
+	if err := bob.Campaign(context.Background()); err != nil {
+		t.Fatalf("Campaign(bob): %v", err)
+	}
+	leader, err = alice.Leader()
+	if err != nil || leader.Identity != bob.Identity {
+		t.Fatalf("Leader = %+v, %v; want bob", leader, err)
+	}
+	if leader.Term <= 1 {
+		t.Fatalf("bob leads in term %d, want a term after alice's", leader.Term)
+	}
+}
+
+func TestElectionLosesLeadershipWithQuorum(t *testing.T) {
+	redlock, fakes := newTestRedlock(3)
+	election := NewElection(redlock, "scheduler", 60*time.Millisecond)
+	if err := election.Campaign(context.Background()); err != nil {
+		t.Fatalf("Campaign: %v", err)
+	}
+
+	for _, fake := range fakes[:2] {
+		fake.SetError(errors.New("boom"))
+	}
+	select {
+	case <-election.Context().Done():
+	case <-time.After(time.Second):
+		t.Fatalf("leader did not notice it lost its quorum")
+	}
+	if term := election.Term(); term != 0 {
+		t.Fatalf("Term after losing the leadership = %d, want 0", term)
+	}
+}
+
+func TestElectionEndsAtValidity(t *testing.T) {
+	redlock, fakes := newTestRedlock(3, func(r *Redlock) {
+		r.RedisConnectTimeout = time.Second
+	})
+	election := NewElection(redlock, "scheduler", 300*time.Millisecond)
+
+	start := time.Now()
+	if err := election.Campaign(context.Background()); err != nil {
+		t.Fatalf("Campaign: %v", err)
+	}
+	for _, fake := range fakes {
+		fake.Partition()
+		defer fake.Heal()
+	}
+
+	select {
+	case <-election.Context().Done():
+	case <-time.After(time.Until(start.Add(300 * time.Millisecond))):
+		t.Fatalf("leader still leads after the TTL of its leadership")
+	}
+	if term := election.Term(); term != 0 {
+		t.Fatalf("Term after the leadership expired = %d, want 0", term)
+	}
+}
+
+func TestElectionRejectsNonPositiveTTL(t *testing.T) {
+	redlock, _ := newTestRedlock(3)
+	for _, ttl := range []time.Duration{0, -time.Second} {
+		election := NewElection(redlock, "scheduler", ttl)
+		if err := election.Campaign(context.Background()); !errors.Is(err, ErrElectionTTL) {
+			t.Fatalf("Campaign with TTL %v = %v, want ErrElectionTTL", ttl, err)
+		}
+	}
+}
+
+func TestElectionResignAfterFailedRenewal(t *testing.T) {
+	redlock, fakes := newTestRedlock(3)
+	alice := NewElection(redlock, "scheduler", time.Second)
+	bob := NewElection(redlock, "scheduler", time.Second)
+	if err := alice.Campaign(context.Background()); err != nil {
+		t.Fatalf("Campaign(alice): %v", err)
+	}
+
+	// A renewal fails while the lock is still held everywhere, and so does
+	// the release of the lost leadership.
+	for _, fake := range fakes[:2] {
+		fake.SetError(errors.New("boom"))
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		alice.mu.Lock()
+		lost := alice.lock == nil
+		alice.mu.Unlock()
+		if lost {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("alice did not notice the failed renewal")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for _, fake := range fakes[:2] {
+		fake.SetError(nil)
+	}
+
+	// Alice re-enters the lock she still holds, then resigns for good.
+	if err := alice.Campaign(context.Background()); err != nil {
+		t.Fatalf("Campaign(alice) again: %v", err)
+	}
+	if err := alice.Resign(); err != nil {
+		t.Fatalf("Resign: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := bob.Campaign(ctx); err != nil {
+		t.Fatalf("Campaign(bob) after alice resigned: %v", err)
+	}
+	if leader, err := alice.Leader(); err != nil || leader.Identity != bob.Identity {
+		t.Fatalf("Leader = %+v, %v; want bob", leader, err)
+	}
+}
+
+func TestElectionObserve(t *testing.T) {
+	redlock, _ := newTestRedlock(3)
+	alice := NewElection(redlock, "scheduler", time.Minute)
+	bob := NewElection(redlock, "scheduler", time.Minute)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	changes := alice.Observe(ctx)
+
+	next := func() Leadership {
+		select {
+		case leadership := <-changes:
+			return leadership
+		case <-ctx.Done():
+			t.Fatalf("no leadership change observed")
+		}
+		return Leadership{}
+	}
+
+	if leadership := next(); leadership != (Leadership{}) {
+		t.Fatalf("first observation = %+v, want no leader", leadership)
+	}
+	if err := alice.Campaign(ctx); err != nil {
+		t.Fatalf("Campaign: %v", err)
+	}
+	if leadership := next(); leadership.Identity != alice.Identity {
+		t.Fatalf("observed %+v, want alice", leadership)
+	}
+	if err := alice.Resign(); err != nil {
+		t.Fatalf("Resign: %v", err)
+	}
+	if leadership := next(); leadership != (Leadership{}) {
+		t.Fatalf("observed %+v after alice resigned, want no leader", leadership)
+	}
+
+	// Bob's election is noticed by polling, which the test speeds up by
+	// waking the observer.
+	if err := bob.Campaign(ctx); err != nil {
+		t.Fatalf("Campaign(bob): %v", err)
+	}
+	alice.notify()
+	if leadership := next(); leadership.Identity != bob.Identity {
+		t.Fatalf("observed %+v, want bob", leadership)
+	}
+
+	cancel()
+	for range changes {
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Notifier is implemented by RedisClients that support publish/subscribe.
+// Fair locks use it to wake waiters as soon as a lock is released.
+type Notifier interface {
+	// Publish sends message to the subscribers of channel.
+	Publish(channel, message string) error
+
+	// Subscribe returns the messages published to channel from now on and
+	// a function that ends the subscription.
+	Subscribe(channel string) (<-chan string, func(), error)
+}
+
+const (
+	// fairTicketScript draws the next ticket of a lock's wait queue.
+	fairTicketScript = "return redis.call('incr', KEYS[1])"
+
+	// fairLockScript queues the waiter under its ticket, refreshes its
+	// heartbeat and drops dead waiters from the head of the queue. The
+	// heartbeats are a sorted set of the waiters by their expiry, measured
+	// on the server's clock. The waiter takes the lock only if it is at the
+	// head and the lock is free. KEYS are the lock, queue, fencing counter
+	// and heartbeats keys; ARGV are the value, TTL, ticket and heartbeat TTL.
+	fairLockScript = `local t = redis.call('time')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+redis.call('zadd', KEYS[2], 'NX', ARGV[3], ARGV[1])
+redis.call('pexpire', KEYS[2], ARGV[4])
+redis.call('zadd', KEYS[4], now + tonumber(ARGV[4]), ARGV[1])
+redis.call('zremrangebyscore', KEYS[4], '-inf', now)
+if redis.call('pttl', KEYS[4]) < tonumber(ARGV[4]) then redis.call('pexpire', KEYS[4], ARGV[4]) end
+local head
+while true do
+  head = redis.call('zrange', KEYS[2], 0, 0)[1]
+  if head == nil or redis.call('zscore', KEYS[4], head) then break end
+  redis.call('zrem', KEYS[2], head)
+end
+if head ~= ARGV[1] or redis.call('exists', KEYS[1]) == 1 then return 0 end
+redis.call('set', KEYS[1], ARGV[1], 'px', ARGV[2])
+redis.call('zrem', KEYS[2], ARGV[1])
+redis.call('zrem', KEYS[4], ARGV[1])
+return redis.call('incr', KEYS[3])`
+
+	// fairLeaveScript removes a waiter that gave up. KEYS are the queue and
+	// heartbeats keys.
+	fairLeaveScript = "redis.call('zrem', KEYS[1], ARGV[1]) redis.call('zrem', KEYS[2], ARGV[1]) return 1"
+)
+
+// WithFairness makes Lock wait in FIFO order. See LockOptions.Fair.
+func WithFairness() func(*LockOptions) {
+	return func(options *LockOptions) {
+		options.Fair = true
+	}
+}
+
+// lockFair acquires lock in FIFO order. The waiter draws a ticket agreed on
+// by a quorum, so that the queues of all servers agree on the order, and
+// then attempts the lock whenever a holder announces a release, and every
+// third of the TTL in case the holder died instead. Every attempt refreshes
+// the waiter's heartbeat; waiters whose heartbeat expired are skipped. The
+// waiter keeps its place until ctx is done, or, if ctx can never be done,
+// for as many attempts as the RetryStrategy allows.
+func (r *Redlock) lockFair(ctx context.Context, lock *Lock, options *LockOptions) (*Lock, error) {
+	queue, seq, heartbeats := fairKeys(lock.Name)
+	ttl := int(options.Validity / time.Millisecond)
+	bounded := ctx.Done() == nil
+
+	ticket, err := r.takeTicket(ctx, seq)
+	if err != nil {
+		return nil, err
+	}
+
+	released, unsubscribe := r.subscribe(releasedChannel(lock.Name))
+	defer unsubscribe()
+
+	req := lockRequest{
+		op: "acquire lock",
+		acquire: func(server RedisClient) (int64, error) {
+			return evalInt(server, fairLockScript, []string{lock.Name, queue, fenceKey(lock.Name), heartbeats},
+				lock.Value, ttl, ticket, ttl)
+		},
+		release: func(server RedisClient) (int64, error) {
+			return lockReleased(server, lock)
+		},
+		fenced: true,
+	}
+
+	leave := func() {
+		r.broadcast(context.Background(), func(server RedisClient) (int64, error) {
+			return evalInt(server, fairLeaveScript, []string{queue, heartbeats}, lock.Value)
+		})
+	}
+
+	for attempts := 1; ; attempts++ {
+		err := r.tryAcquire(ctx, lock, options.Validity, req)
+		if err == nil {
+			return lock, nil
+		}
+
+		if bounded {
+			if _, retry := r.retry(attempts); !retry {
+				leave()
+				return nil, err
+			}
+		}
+
+		if ctx.Err() == nil {
+			r.observe(ObserverEvent{Kind: RetryEvent, Op: req.op, Name: lock.Name, Attempt: attempts, Delay: options.Validity / 3})
+			timer := time.NewTimer(options.Validity / 3)
+			select {
+			case <-ctx.Done():
+			case <-released:
+			case <-timer.C:
+			}
+			timer.Stop()
+		}
+
+		if ctx.Err() != nil {
+			leave()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// takeTicket draws a ticket from a quorum of servers. Like fencing tokens,
+// the ticket is the highest counter among the voters and is written back so
+// that later waiters draw larger tickets.
+func (r *Redlock) takeTicket(ctx context.Context, seq string) (uint64, error) {
+	results, n := r.quorumRound(ctx, func(server RedisClient) (int64, error) {
+		return evalInt(server, fairTicketScript, []string{seq})
+	})
+	if n < r.quorum {
+		return 0, &QuorumError{Op: "take ticket", Quorum: r.quorum, Results: results}
+	}
+
+	ticket := highestReply(results)
+	results, n = r.quorumRound(ctx, func(server RedisClient) (int64, error) {
+		return evalInt(server, raiseFenceScript, []string{seq}, ticket)
+	})
+	if n < r.quorum {
+		return 0, &QuorumError{Op: "take ticket", Quorum: r.quorum, Results: results}
+	}
+	return ticket, nil
+}
+
+// subscribe merges the notifications of every server that is a Notifier
+// into a single channel. Notifications that arrive while one is pending are
+// dropped, since a single wake-up is all a waiter needs.
+func (r *Redlock) subscribe(channel string) (<-chan struct{}, func()) {
+	notified := make(chan struct{}, 1)
+	done := make(chan struct{})
+	var cancels []func()
+	var wg sync.WaitGroup
+
+	for _, server := range r.servers {
+		notifier, ok := unwrapScripts(server).(Notifier)
+		if !ok {
+			continue
+		}
+		messages, cancel, err := notifier.Subscribe(channel)
+		if err != nil {
+			continue
+		}
+		cancels = append(cancels, cancel)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				case _, ok := <-messages:
+					if !ok {
+						return
+					}
+					select {
+					case notified <- struct{}{}:
+					default:
+					}
+				}
+			}
+		}()
+	}
+
+	return notified, func() {
+		close(done)
+		for _, cancel := range cancels {
+			cancel()
+		}
+		wg.Wait()
+	}
+}
+
+// notifyReleased tells the waiters of a fair lock that it was released.
+func (r *Redlock) notifyReleased(name string) {
+	r.broadcast(context.Background(), func(server RedisClient) (int64, error) {
+		if notifier, ok := unwrapScripts(server).(Notifier); ok {
+			return 1, notifier.Publish(releasedChannel(name), "released")
+		}
+		return 0, nil
+	})
+}
+
+// fairKeys returns the queue, ticket counter and heartbeats keys of a fair
+// lock.
+func fairKeys(name string) (string, string, string) {
+	return name + ":queue", name + ":queue-seq", name + ":heartbeats"
+}
+
+func releasedChannel(name string) string {
+	return name + ":released"
+}
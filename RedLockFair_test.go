@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestFairLockIsFIFO(t *testing.T) {
+	redlock, _ := newTestRedlock(3)
+
+	holder, err := redlock.Lock("my-lock", withValidity(time.Minute), WithFairness())
+	if err != nil {
+		t.Fatalf("Lock: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	acquired := make(chan string, 3)
+	locks := make(chan *Lock, 3)
+	for i := 0; i < 3; i++ {
+		name := fmt.Sprintf("waiter-%d", i)
+		go func() {
+			lock, err := redlock.LockContext(ctx, "my-lock", withValidity(time.Minute), WithFairness())
+			if err != nil {
+				acquired <- name + ": " + err.Error()
+				return
+			}
+			acquired <- name
+			locks <- lock
+		}()
+		// Give the waiter time to take its ticket before the next one.
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	if err := redlock.Unlock(holder); err != nil {
+		t.Fatalf("Unlock: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		want := fmt.Sprintf("waiter-%d", i)
+		if got := <-acquired; got != want {
+			t.Fatalf("lock %d went to %s, want %s", i, got, want)
+		}
+		if err := redlock.Unlock(<-locks); err != nil {
+			t.Fatalf("Unlock: %v", err)
+		}
+	}
+}
+
+func TestFairLockWakesWaiterOnUnlock(t *testing.T) {
+	redlock, _ := newTestRedlock(3)
+
+	// Without a notification the waiter would retry only after a third of
+	// the validity, i.e. 10 seconds.
+	holder, err := redlock.Lock("my-lock", withValidity(30*time.Second), WithFairness())
+	if err != nil {
+		t.Fatalf("Lock: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := redlock.LockContext(ctx, "my-lock", withValidity(30*time.Second), WithFairness())
+		done <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	start := time.Now()
+	if err := redlock.Unlock(holder); err != nil {
+		t.Fatalf("Unlock: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("LockContext: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("waiter took %v to notice the release", elapsed)
+	}
+}
+
+func TestFairLockSkipsDeadWaiters(t *testing.T) {
+	redlock, fakes := newTestRedlock(3)
+
+	holder, err := redlock.Lock("my-lock", withValidity(time.Minute), WithFairness())
+	if err != nil {
+		t.Fatalf("Lock: %v", err)
+	}
+
+	// A waiter that queued first, with a 30ms heartbeat, and then died.
+	queue, _, heartbeats := fairKeys("my-lock")
+	for _, fake := range fakes {
+		_, err := fake.Eval(fairLockScript, []string{"my-lock", queue, fenceKey("my-lock"), heartbeats},
+			"dead", 60000, 0, 30)
+		if err != nil {
+			t.Fatalf("queueing the dead waiter: %v", err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := redlock.LockContext(ctx, "my-lock", withValidity(time.Minute), WithFairness())
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	if err := redlock.Unlock(holder); err != nil {
+		t.Fatalf("Unlock: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("LockContext behind a dead waiter: %v", err)
+	}
+}
+
+func TestFairLockLeavesQueueOnCancel(t *testing.T) {
+	redlock, _ := newTestRedlock(3)
+
+	holder, err := redlock.Lock("my-lock", withValidity(time.Minute), WithFairness())
+	if err != nil {
+		t.Fatalf("Lock: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := redlock.LockContext(ctx, "my-lock", withValidity(time.Minute), WithFairness()); err != context.DeadlineExceeded {
+		t.Fatalf("LockContext = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// The waiter that gave up must not hold up the next one.
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := redlock.LockContext(ctx, "my-lock", withValidity(time.Minute), WithFairness())
+		done <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	if err := redlock.Unlock(holder); err != nil {
+		t.Fatalf("Unlock: %v", err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("LockContext: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("waiter was held up by one that gave up")
+	}
+}
+
+func TestFairLockWithoutDeadlineFollowsRetryStrategy(t *testing.T) {
+	redlock, _ := newTestRedlock(3, WithRetryStrategy(FixedRetry(2, 0)))
+
+	holder, err := redlock.Lock("my-lock", withValidity(300*time.Millisecond), WithFairness())
+	if err != nil {
+		t.Fatalf("Lock: %v", err)
+	}
+
+	// Lock cannot be cancelled, so the waiter gives up after two attempts
+	// rather than waiting for the holder forever.
+	start := time.Now()
+	var quorumErr *QuorumError
+	if _, err := redlock.Lock("my-lock", withValidity(300*time.Millisecond), WithFairness()); !errors.As(err, &quorumErr) {
+		t.Fatalf("Lock of a held fair lock = %v, want a QuorumError", err)
+	}
+	if elapsed := time.Since(start); elapsed > 250*time.Millisecond {
+		t.Fatalf("Lock took %v, want it to give up after two attempts", elapsed)
+	}
+
+	// The waiter that gave up left the queue.
+	if err := redlock.Unlock(holder); err != nil {
+		t.Fatalf("Unlock: %v", err)
+	}
+	if _, err := redlock.Lock("my-lock", withValidity(300*time.Millisecond), WithFairness()); err != nil {
+		t.Fatalf("Lock after the holder released the lock: %v", err)
+	}
+}
+
+func TestFakeRejectsUndeclaredKeys(t *testing.T) {
+	fake := NewFakeRedis()
+	script := func(f *FakeRedis, keys []string, args []string) (interface{}, error) {
+		f.set(keys[0], args[0], 0)
+		return f.exists(args[1]), nil
+	}
+
+	err := fake.do(func() error {
+		_, err := fake.run(script, "script", []string{"declared"}, []interface{}{"value", "other"})
+		return err
+	})
+	if !errors.Is(err, ErrFakeUndeclaredKey) {
+		t.Fatalf("script that reads a key from ARGV returned %v, want ErrFakeUndeclaredKey", err)
+	}
+	if value, err := fake.Get("other"); err != nil || value != nil {
+		t.Fatalf("Get outside of a script = %v, %v", value, err)
+	}
+}
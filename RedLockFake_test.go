@@ -0,0 +1,788 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrFakeDown is returned by a FakeRedis that has crashed.
+var ErrFakeDown = errors.New("fake redis: server is down")
+
+// ErrFakeUndeclaredKey is returned by a FakeRedis for scripts that access a
+// key they were not given in KEYS. Redis Cluster cannot route such scripts,
+// and neither can a proxy that shards by key.
+var ErrFakeUndeclaredKey = errors.New("fake redis: script accessed a key not declared in KEYS")
+
+// ErrFakePartitioned is returned by a FakeRedis for requests that were sent
+// while it was partitioned away. Such requests are never applied.
+var ErrFakePartitioned = errors.New("fake redis: request lost in partition")
+
+// fakeScript implements a Lua script in Go against a FakeRedis whose lock is
+// held. Arguments arrive as strings, just like they do in Redis.
+type fakeScript func(f *FakeRedis, keys []string, args []string) (interface{}, error)
+
+// fakeScripts maps the source of every script Redlock sends to its Go
+// implementation.
+var fakeScripts = map[string]fakeScript{
+	lockScript: func(f *FakeRedis, keys []string, args []string) (interface{}, error) {
+		if _, ok := f.get(keys[0]); ok {
+			return int64(0), nil
+		}
+		f.set(keys[0], args[0], 0)
+		if err := f.pexpire(keys[0], args[1]); err != nil {
+			return nil, err
+		}
+		return f.incr(keys[1])
+	},
+	unlockScript: func(f *FakeRedis, keys []string, args []string) (interface{}, error) {
+		if value, ok := f.get(keys[0]); !ok || value != args[0] {
+			return int64(0), nil
+		}
+		f.del(keys[0])
+		return int64(1), nil
+	},
+	extendScript: func(f *FakeRedis, keys []string, args []string) (interface{}, error) {
+		if value, ok := f.get(keys[0]); !ok || value != args[0] {
+			return int64(0), nil
+		}
+		for _, key := range keys {
+			if err := f.pexpire(key, args[1]); err != nil {
+				return nil, err
+			}
+		}
+		return int64(1), nil
+	},
+	reentrantLockScript: func(f *FakeRedis, keys []string, args []string) (interface{}, error) {
+		// The set of holds is kept as a sorted set with equal scores.
+		value, ok := f.get(keys[0])
+		if !ok {
+			f.set(keys[0], args[0], 0)
+			f.del(keys[1])
+			f.zadd(keys[1], args[2], 0)
+			for _, key := range keys[:2] {
+				if err := f.pexpire(key, args[1]); err != nil {
+					return nil, err
+				}
+			}
+			return f.incr(keys[2])
+		}
+		if value != args[0] {
+			return int64(0), nil
+		}
+		f.zadd(keys[1], args[2], 0)
+		ttl, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		if current := f.pttl(keys[0]); current > ttl {
+			ttl = current
+		}
+		for _, key := range keys[:2] {
+			if err := f.pexpire(key, strconv.FormatInt(ttl, 10)); err != nil {
+				return nil, err
+			}
+		}
+		token, err := f.integer(keys[2])
+		if token < 1 {
+			token = 1
+		}
+		return token, err
+	},
+	reentrantUnlockScript: func(f *FakeRedis, keys []string, args []string) (interface{}, error) {
+		if value, ok := f.get(keys[0]); !ok || value != args[0] {
+			return int64(0), nil
+		}
+		if f.zrem(keys[1], args[1]) == 0 {
+			return int64(0), nil
+		}
+		if f.zcard(keys[1]) == 0 {
+			f.del(keys[0])
+			f.del(keys[1])
+		}
+		return int64(1), nil
+	},
+	rwReadLockScript: func(f *FakeRedis, keys []string, args []string) (interface{}, error) {
+		if f.exists(keys[0]) || f.exists(keys[2]) {
+			return int64(0), nil
+		}
+		ttl, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		f.zadd(keys[1], args[0], f.millis()+ttl)
+		if f.pttl(keys[1]) < ttl {
+			if err := f.pexpire(keys[1], args[1]); err != nil {
+				return nil, err
+			}
+		}
+		return int64(1), nil
+	},
+	rwReadUnlockScript: func(f *FakeRedis, keys []string, args []string) (interface{}, error) {
+		return f.zrem(keys[0], args[0]), nil
+	},
+	rwWriteLockScript: func(f *FakeRedis, keys []string, args []string) (interface{}, error) {
+		f.zremBelow(keys[1], f.millis())
+		if f.exists(keys[0]) {
+			return int64(0), nil
+		}
+		if intent, ok := f.get(keys[2]); ok && intent != args[0] {
+			return int64(0), nil
+		}
+		if f.zcard(keys[1]) > 0 {
+			f.set(keys[2], args[0], 0)
+			return int64(0), f.pexpire(keys[2], args[1])
+		}
+		f.set(keys[0], args[0], 0)
+		f.del(keys[2])
+		if err := f.pexpire(keys[0], args[1]); err != nil {
+			return nil, err
+		}
+		return int64(1), nil
+	},
+	rwWriteUnlockScript: func(f *FakeRedis, keys []string, args []string) (interface{}, error) {
+		if intent, ok := f.get(keys[1]); ok && intent == args[0] {
+			f.del(keys[1])
+		}
+		if value, ok := f.get(keys[0]); !ok || value != args[0] {
+			return int64(0), nil
+		}
+		f.del(keys[0])
+		return int64(1), nil
+	},
+	multiLockScript: func(f *FakeRedis, keys []string, args []string) (interface{}, error) {
+		for _, key := range keys {
+			if f.exists(key) {
+				return int64(0), nil
+			}
+		}
+		for _, key := range keys {
+			f.set(key, args[0], 0)
+			if err := f.pexpire(key, args[1]); err != nil {
+				return nil, err
+			}
+		}
+		return int64(1), nil
+	},
+	multiUnlockScript: func(f *FakeRedis, keys []string, args []string) (interface{}, error) {
+		all := int64(1)
+		for _, key := range keys {
+			if value, ok := f.get(key); ok && value == args[0] {
+				f.del(key)
+			} else {
+				all = 0
+			}
+		}
+		return all, nil
+	},
+	multiExtendScript: func(f *FakeRedis, keys []string, args []string) (interface{}, error) {
+		for _, key := range keys {
+			if value, ok := f.get(key); !ok || value != args[0] {
+				return int64(0), nil
+			}
+		}
+		for _, key := range keys {
+			if err := f.pexpire(key, args[1]); err != nil {
+				return nil, err
+			}
+		}
+		return int64(1), nil
+	},
+	raiseFenceScript: func(f *FakeRedis, keys []string, args []string) (interface{}, error) {
+		current, err := f.integer(keys[0])
+		if err != nil {
+			return nil, err
+		}
+		token, err := strconv.ParseInt(args[0], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		if current < token {
+			f.set(keys[0], args[0], 0)
+		}
+		return int64(1), nil
+	},
+	inspectScript: func(f *FakeRedis, keys []string, args []string) (interface{}, error) {
+		var value interface{}
+		if v, ok := f.get(keys[0]); ok {
+			value = v
+		}
+		return []interface{}{value, f.pttl(keys[0])}, nil
+	},
+	fairTicketScript: func(f *FakeRedis, keys []string, args []string) (interface{}, error) {
+		return f.incr(keys[0])
+	},
+	fairLockScript: func(f *FakeRedis, keys []string, args []string) (interface{}, error) {
+		ticket, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := f.zscore(keys[1], args[0]); !ok {
+			f.zadd(keys[1], args[0], ticket)
+		}
+		if err := f.pexpire(keys[1], args[3]); err != nil {
+			return nil, err
+		}
+		heartbeat, err := strconv.ParseInt(args[3], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		f.zadd(keys[3], args[0], f.millis()+heartbeat)
+		f.zremBelow(keys[3], f.millis())
+		if f.pttl(keys[3]) < heartbeat {
+			if err := f.pexpire(keys[3], args[3]); err != nil {
+				return nil, err
+			}
+		}
+
+		head, ok := f.zhead(keys[1])
+		for ok {
+			if _, alive := f.zscore(keys[3], head); alive {
+				break
+			}
+			f.zrem(keys[1], head)
+			head, ok = f.zhead(keys[1])
+		}
+		if head != args[0] || f.exists(keys[0]) {
+			return int64(0), nil
+		}
+
+		f.set(keys[0], args[0], 0)
+		if err := f.pexpire(keys[0], args[1]); err != nil {
+			return nil, err
+		}
+		f.zrem(keys[1], args[0])
+		f.zrem(keys[3], args[0])
+		return f.incr(keys[2])
+	},
+	fairLeaveScript: func(f *FakeRedis, keys []string, args []string) (interface{}, error) {
+		f.zrem(keys[0], args[0])
+		f.zrem(keys[1], args[0])
+		return int64(1), nil
+	},
+}
+
+// fakeEntry is a key stored in a FakeRedis. It holds either a string value
+// or a sorted set. expiresAt is measured on the server's own clock and is
+// zero for keys without a TTL.
+type fakeEntry struct {
+	value     string
+	zset      map[string]int64
+	expiresAt time.Time
+}
+
+// FakeRedis is an in-memory RedisClient for tests. It understands the
+// scripts Redlock sends and can be told to misbehave: respond slowly, fail,
+// crash and restart, be partitioned away, or run its TTL clock skewed.
+type FakeRedis struct {
+	mu sync.Mutex
+
+	data map[string]fakeEntry
+
+	// now is the real clock the server's own clock is derived from.
+	now func() time.Time
+
+	// The server's clock reads anchorLocal at anchorReal and advances rate
+	// times as fast as the real clock from there.
+	anchorReal  time.Time
+	anchorLocal time.Time
+	rate        float64
+
+	latency time.Duration
+	err     error
+	down    bool
+
+	// partition is closed when a partition heals; it is nil while the
+	// server is reachable.
+	partition chan struct{}
+
+	// subscribers are the channels of the subscriptions to each channel.
+	subscribers map[string][]chan string
+
+	// scripts is the script cache, by SHA1 digest. Like Redis, the fake
+	// loses it on every crash.
+	scripts map[string]string
+
+	// received counts the bytes of the scripts, digests and arguments sent
+	// to the server.
+	received int64
+
+	// declared are the KEYS of the running script, and nil outside of
+	// scripts. undeclared is the first other key the script accessed.
+	declared   map[string]bool
+	undeclared string
+}
+
+// NewFakeRedis creates an empty, healthy FakeRedis.
+func NewFakeRedis() *FakeRedis {
+	now := time.Now()
+	return &FakeRedis{
+		data:        make(map[string]fakeEntry),
+		subscribers: make(map[string][]chan string),
+		scripts:     make(map[string]string),
+		now:         time.Now,
+		anchorReal:  now,
+		anchorLocal: now,
+		rate:        1,
+	}
+}
+
+// NewFakeCluster creates n FakeRedis servers and returns them both as fakes,
+// for injecting faults, and as RedisClients, for NewRedlock.
+func NewFakeCluster(n int) ([]*FakeRedis, []RedisClient) {
+	fakes := make([]*FakeRedis, n)
+	servers := make([]RedisClient, n)
+	for i := range fakes {
+		fakes[i] = NewFakeRedis()
+		servers[i] = fakes[i]
+	}
+	return fakes, servers
+}
+
+// SetLatency makes every request wait d before it is served.
+func (f *FakeRedis) SetLatency(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.latency = d
+}
+
+// SetError makes every request fail with err until it is reset with nil.
+func (f *FakeRedis) SetError(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.err = err
+}
+
+// Crash takes the server down. Unless keepData is set, which simulates a
+// server that persists every write, all keys are lost.
+func (f *FakeRedis) Crash(keepData bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.down = true
+	f.scripts = make(map[string]string)
+	if !keepData {
+		f.data = make(map[string]fakeEntry)
+	}
+}
+
+// Restart brings a crashed server back up.
+func (f *FakeRedis) Restart() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.down = false
+}
+
+// Partition cuts the server off. Requests sent while it is partitioned hang
+// until Heal is called and then fail with ErrFakePartitioned.
+func (f *FakeRedis) Partition() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.partition == nil {
+		f.partition = make(chan struct{})
+	}
+}
+
+// Heal ends a partition.
+func (f *FakeRedis) Heal() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.partition != nil {
+		close(f.partition)
+		f.partition = nil
+	}
+}
+
+// JumpClock moves the server's clock by d, e.g. to simulate an NTP step.
+// Jumping forward expires keys early.
+func (f *FakeRedis) JumpClock(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.anchorLocal = f.anchorLocal.Add(d)
+}
+
+// SetClockRate makes the server's clock run rate times as fast as the real
+// clock from now on. A rate above 1 expires keys early.
+func (f *FakeRedis) SetClockRate(rate float64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.anchorLocal = f.clock()
+	f.anchorReal = f.now()
+	f.rate = rate
+}
+
+// Keys returns the number of live keys, for assertions in tests.
+func (f *FakeRedis) Keys() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	n := 0
+	for key := range f.data {
+		if _, ok := f.get(key); ok {
+			n++
+		}
+	}
+	return n
+}
+
+// Set sets the value of a key.
+func (f *FakeRedis) Set(key string, value interface{}, expiration time.Duration) error {
+	return f.do(func() error {
+		f.set(key, fmt.Sprint(value), expiration)
+		return nil
+	})
+}
+
+// Get gets the value of a key. A missing key yields a nil value.
+func (f *FakeRedis) Get(key string) (interface{}, error) {
+	var value interface{}
+	err := f.do(func() error {
+		if v, ok := f.get(key); ok {
+			value = v
+		}
+		return nil
+	})
+	return value, err
+}
+
+// Del deletes a key.
+func (f *FakeRedis) Del(key string) error {
+	return f.do(func() error {
+		f.del(key)
+		return nil
+	})
+}
+
+// Eval runs one of the scripts the fake knows about.
+func (f *FakeRedis) Eval(script string, keys []string, args ...interface{}) (interface{}, error) {
+	impl, ok := fakeScripts[script]
+	if !ok {
+		return nil, fmt.Errorf("fake redis: unknown script %q", script)
+	}
+
+	var reply interface{}
+	err := f.do(func() error {
+		var err error
+		reply, err = f.run(impl, script, keys, args)
+		return err
+	})
+	return reply, err
+}
+
+// ScriptLoad adds one of the scripts the fake knows about to its script
+// cache.
+func (f *FakeRedis) ScriptLoad(script string) (string, error) {
+	if _, ok := fakeScripts[script]; !ok {
+		return "", fmt.Errorf("fake redis: unknown script %q", script)
+	}
+
+	sha := scriptSHA(script)
+	err := f.do(func() error {
+		f.received += int64(len(script))
+		f.scripts[sha] = script
+		return nil
+	})
+	return sha, err
+}
+
+// EvalSha runs a script from the script cache.
+func (f *FakeRedis) EvalSha(sha string, keys []string, args ...interface{}) (interface{}, error) {
+	var reply interface{}
+	err := f.do(func() error {
+		script, ok := f.scripts[sha]
+		if !ok {
+			f.received += int64(len(sha))
+			return ErrNoScript
+		}
+		var err error
+		reply, err = f.run(fakeScripts[script], sha, keys, args)
+		return err
+	})
+	return reply, err
+}
+
+// BytesReceived returns the number of bytes of scripts, digests, keys and
+// arguments sent to the server so far.
+func (f *FakeRedis) BytesReceived() int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.received
+}
+
+// run runs impl, accounting for the bytes of the request. script is the
+// script or digest that was sent.
+func (f *FakeRedis) run(impl fakeScript, script string, keys []string, args []interface{}) (interface{}, error) {
+	f.received += int64(len(script))
+	for _, key := range keys {
+		f.received += int64(len(key))
+	}
+
+	strs := make([]string, len(args))
+	for i, arg := range args {
+		strs[i] = fmt.Sprint(arg)
+		f.received += int64(len(strs[i]))
+	}
+
+	f.declared = make(map[string]bool, len(keys))
+	for _, key := range keys {
+		f.declared[key] = true
+	}
+	defer func() {
+		f.declared, f.undeclared = nil, ""
+	}()
+
+	reply, err := impl(f, keys, strs)
+	if err == nil && f.undeclared != "" {
+		return nil, fmt.Errorf("%w: %q", ErrFakeUndeclaredKey, f.undeclared)
+	}
+	return reply, err
+}
+
+// access records key as undeclared if a running script did not declare it.
+func (f *FakeRedis) access(key string) {
+	if f.declared != nil && !f.declared[key] && f.undeclared == "" {
+		f.undeclared = key
+	}
+}
+
+// Publish delivers message to the current subscribers of channel. Like
+// Redis, it does not wait for slow subscribers: a subscriber whose buffer is
+// full misses the message.
+func (f *FakeRedis) Publish(channel, message string) error {
+	return f.do(func() error {
+		for _, messages := range f.subscribers[channel] {
+			select {
+			case messages <- message:
+			default:
+			}
+		}
+		return nil
+	})
+}
+
+// Subscribe returns the messages published to channel from now on.
+func (f *FakeRedis) Subscribe(channel string) (<-chan string, func(), error) {
+	messages := make(chan string, 16)
+	err := f.do(func() error {
+		f.subscribers[channel] = append(f.subscribers[channel], messages)
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var once sync.Once
+	return messages, func() {
+		once.Do(func() {
+			f.mu.Lock()
+			defer f.mu.Unlock()
+
+			subscribers := f.subscribers[channel]
+			for i, subscriber := range subscribers {
+				if subscriber == messages {
+					f.subscribers[channel] = append(subscribers[:i:i], subscribers[i+1:]...)
+					break
+				}
+			}
+			close(messages)
+		})
+	}, nil
+}
+
+// do applies the injected faults and runs op with the server locked.
+func (f *FakeRedis) do(op func() error) error {
+	f.mu.Lock()
+	latency, partition := f.latency, f.partition
+	f.mu.Unlock()
+
+	if latency > 0 {
+		time.Sleep(latency)
+	}
+	if partition != nil {
+		<-partition
+		return ErrFakePartitioned
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.down {
+		return ErrFakeDown
+	}
+	if f.err != nil {
+		return f.err
+	}
+	return op()
+}
+
+// clock returns the server's own, possibly skewed, time.
+func (f *FakeRedis) clock() time.Time {
+	elapsed := f.now().Sub(f.anchorReal)
+	return f.anchorLocal.Add(time.Duration(float64(elapsed) * f.rate))
+}
+
+// entry returns the live entry for key, dropping it if it has expired.
+func (f *FakeRedis) entry(key string) (fakeEntry, bool) {
+	f.access(key)
+	entry, ok := f.data[key]
+	if !ok {
+		return fakeEntry{}, false
+	}
+	if !entry.expiresAt.IsZero() && !f.clock().Before(entry.expiresAt) {
+		delete(f.data, key)
+		return fakeEntry{}, false
+	}
+	return entry, true
+}
+
+func (f *FakeRedis) get(key string) (string, bool) {
+	entry, ok := f.entry(key)
+	return entry.value, ok
+}
+
+func (f *FakeRedis) exists(key string) bool {
+	_, ok := f.entry(key)
+	return ok
+}
+
+// millis returns the server's clock in milliseconds, like TIME does.
+func (f *FakeRedis) millis() int64 {
+	return f.clock().UnixNano() / int64(time.Millisecond)
+}
+
+// pttl returns the remaining TTL of key in milliseconds, -1 for a key
+// without a TTL and -2 for a missing key.
+func (f *FakeRedis) pttl(key string) int64 {
+	entry, ok := f.entry(key)
+	if !ok {
+		return -2
+	}
+	if entry.expiresAt.IsZero() {
+		return -1
+	}
+	return int64(entry.expiresAt.Sub(f.clock()) / time.Millisecond)
+}
+
+func (f *FakeRedis) zadd(key, member string, score int64) {
+	entry, ok := f.entry(key)
+	if !ok || entry.zset == nil {
+		entry = fakeEntry{zset: make(map[string]int64), expiresAt: entry.expiresAt}
+	}
+	entry.zset[member] = score
+	f.data[key] = entry
+}
+
+func (f *FakeRedis) zrem(key, member string) int64 {
+	entry, _ := f.entry(key)
+	if _, ok := entry.zset[member]; !ok {
+		return 0
+	}
+	delete(entry.zset, member)
+	if len(entry.zset) == 0 {
+		delete(f.data, key)
+	}
+	return 1
+}
+
+// zremBelow removes the members of key scored at most max.
+func (f *FakeRedis) zremBelow(key string, max int64) {
+	entry, ok := f.entry(key)
+	if !ok {
+		return
+	}
+	for member, score := range entry.zset {
+		if score <= max {
+			delete(entry.zset, member)
+		}
+	}
+	if len(entry.zset) == 0 {
+		delete(f.data, key)
+	}
+}
+
+func (f *FakeRedis) zscore(key, member string) (int64, bool) {
+	entry, _ := f.entry(key)
+	score, ok := entry.zset[member]
+	return score, ok
+}
+
+// zhead returns the member of key with the lowest score. Like Redis, it
+// orders members with equal scores lexicographically.
+func (f *FakeRedis) zhead(key string) (string, bool) {
+	entry, _ := f.entry(key)
+	head, found := "", false
+	for member, score := range entry.zset {
+		if !found || score < entry.zset[head] || score == entry.zset[head] && member < head {
+			head, found = member, true
+		}
+	}
+	return head, found
+}
+
+func (f *FakeRedis) zcard(key string) int64 {
+	entry, _ := f.entry(key)
+	return int64(len(entry.zset))
+}
+
+func (f *FakeRedis) set(key, value string, expiration time.Duration) {
+	f.access(key)
+	entry := fakeEntry{value: value}
+	if expiration > 0 {
+		entry.expiresAt = f.clock().Add(expiration)
+	}
+	f.data[key] = entry
+}
+
+func (f *FakeRedis) del(key string) {
+	f.access(key)
+	delete(f.data, key)
+}
+
+func (f *FakeRedis) pexpire(key, milliseconds string) error {
+	ms, err := strconv.ParseInt(milliseconds, 10, 64)
+	if err != nil {
+		return err
+	}
+	f.access(key)
+	entry, ok := f.data[key]
+	if !ok {
+		return nil
+	}
+	entry.expiresAt = f.clock().Add(time.Duration(ms) * time.Millisecond)
+	f.data[key] = entry
+	return nil
+}
+
+func (f *FakeRedis) integer(key string) (int64, error) {
+	value, ok := f.get(key)
+	if !ok {
+		return 0, nil
+	}
+	return strconv.ParseInt(value, 10, 64)
+}
+
+func (f *FakeRedis) incr(key string) (int64, error) {
+	return f.incrBy(key, 1)
+}
+
+func (f *FakeRedis) incrBy(key string, by int64) (int64, error) {
+	n, err := f.integer(key)
+	if err != nil {
+		return 0, err
+	}
+	n += by
+	entry := f.data[key]
+	entry.value = strconv.FormatInt(n, 10)
+	f.data[key] = entry
+	return n, nil
+}
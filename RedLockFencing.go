@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// raiseFenceScript raises the fencing counter to ARGV[1] unless it is
+// already at least that high.
+const raiseFenceScript = "local c = tonumber(redis.call('get', KEYS[1]) or '0') if c < tonumber(ARGV[1]) then redis.call('set', KEYS[1], ARGV[1]) end return 1"
+
+// raiseFence writes the lock's token back to the fencing counter of every
+// server. The servers that voted for a lock may have had different counters,
+// so the token is the highest of them; raising a quorum of counters to it
+// guarantees that the next holder, whose quorum must overlap this one, is
+// issued a larger token.
+func (r *Redlock) raiseFence(ctx context.Context, lock *Lock) ([]ServerResult, int) {
+	return r.quorumRound(ctx, func(server RedisClient) (int64, error) {
+		return evalInt(server, raiseFenceScript, []string{fenceKey(lock.Name)}, lock.Token)
+	})
+}
+
+// highestReply returns the highest reply among the servers that voted.
+func highestReply(results []ServerResult) uint64 {
+	var highest uint64
+	for _, result := range results {
+		if result.Voted && uint64(result.Reply) > highest {
+			highest = uint64(result.Reply)
+		}
+	}
+	return highest
+}
+
+// ErrStaleToken is returned by FenceGuard for a token older than one it has
+// already accepted.
+var ErrStaleToken = errors.New("stale fencing token")
+
+// FenceGuard is meant to sit in front of the storage protected by a lock. It
+// remembers the highest fencing token accepted per resource and rejects
+// writes carrying an older one, e.g. from a client that was paused while its
+// lock expired and was handed to someone else.
+type FenceGuard struct {
+	mu      sync.Mutex
+	highest map[string]uint64
+}
+
+// NewFenceGuard creates an empty FenceGuard.
+func NewFenceGuard() *FenceGuard {
+	return &FenceGuard{highest: make(map[string]uint64)}
+}
+
+// Check accepts token for resource if it is at least as high as every token
+// accepted for resource before, and returns ErrStaleToken otherwise.
+func (g *FenceGuard) Check(resource string, token uint64) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if highest := g.highest[resource]; token < highest {
+		return fmt.Errorf("%w: %d is older than %d for %s", ErrStaleToken, token, highest, resource)
+	}
+	g.highest[resource] = token
+	return nil
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// GoRedisClient is a RedisClient backed by a go-redis v8 client.
+type GoRedisClient struct {
+	// client is the underlying go-redis client.
+	client *redis.Client
+
+	// timeout bounds every call made through the adapter.
+	timeout time.Duration
+}
+
+// NewGoRedisClient creates a RedisClient for the Redis server at addr.
+// Every call made through the client is bounded by timeout.
+func NewGoRedisClient(addr string, timeout time.Duration) *GoRedisClient {
+	return &GoRedisClient{
+		client: redis.NewClient(&redis.Options{
+			Addr:         addr,
+			DialTimeout:  timeout,
+			ReadTimeout:  timeout,
+			WriteTimeout: timeout,
+			// Redlock already retries whole attempts; a transparent retry of a
+			// lock script could apply it twice on the same server.
+			MaxRetries: -1,
+		}),
+		timeout: timeout,
+	}
+}
+
+// NewGoRedisClients creates one RedisClient per address.
+func NewGoRedisClients(addrs []string, timeout time.Duration) []RedisClient {
+	servers := make([]RedisClient, 0, len(addrs))
+	for _, addr := range addrs {
+		servers = append(servers, NewGoRedisClient(addr, timeout))
+	}
+	return servers
+}
+
+// NewRedlockFromAddrs creates a new Redlock that talks to the Redis servers
+// at the given addresses. The clients honour the RedisConnectTimeout that is
+// in effect once all options have been applied.
+func NewRedlockFromAddrs(addrs []string, opts ...func(*Redlock)) *Redlock {
+	r := NewRedlock(nil, opts...)
+	r.servers = withScripts(NewGoRedisClients(addrs, r.RedisConnectTimeout), r.scripts)
+	r.quorum = len(r.servers)/2 + 1
+	return r
+}
+
+// Set sets the value of a key.
+func (c *GoRedisClient) Set(key string, value interface{}, expiration time.Duration) error {
+	ctx, cancel := c.context()
+	defer cancel()
+
+	return c.client.Set(ctx, key, value, expiration).Err()
+}
+
+// Get gets the value of a key. A missing key yields a nil value and no error.
+func (c *GoRedisClient) Get(key string) (interface{}, error) {
+	ctx, cancel := c.context()
+	defer cancel()
+
+	value, err := c.client.Get(ctx, key).Result()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// Del deletes a key.
+func (c *GoRedisClient) Del(key string) error {
+	ctx, cancel := c.context()
+	defer cancel()
+
+	return c.client.Del(ctx, key).Err()
+}
+
+// Eval runs a Redis script. Integer replies are returned as int64 and a nil
+// reply is returned as int64(0), which is what the Redlock scripts treat as
+// "not acquired" or "not released".
+func (c *GoRedisClient) Eval(script string, keys []string, args ...interface{}) (interface{}, error) {
+	ctx, cancel := c.context()
+	defer cancel()
+
+	value, err := c.client.Eval(ctx, script, keys, args...).Result()
+	if errors.Is(err, redis.Nil) {
+		return int64(0), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// ScriptLoad loads script into the server's script cache.
+func (c *GoRedisClient) ScriptLoad(script string) (string, error) {
+	ctx, cancel := c.context()
+	defer cancel()
+
+	return c.client.ScriptLoad(ctx, script).Result()
+}
+
+// EvalSha runs a cached script. Replies are returned like Eval returns them,
+// and a NOSCRIPT error is returned as ErrNoScript.
+func (c *GoRedisClient) EvalSha(sha string, keys []string, args ...interface{}) (interface{}, error) {
+	ctx, cancel := c.context()
+	defer cancel()
+
+	value, err := c.client.EvalSha(ctx, sha, keys, args...).Result()
+	if errors.Is(err, redis.Nil) {
+		return int64(0), nil
+	}
+	if err != nil && strings.HasPrefix(err.Error(), "NOSCRIPT") {
+		return nil, fmt.Errorf("%w: %v", ErrNoScript, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// Publish publishes message to channel.
+func (c *GoRedisClient) Publish(channel, message string) error {
+	ctx, cancel := c.context()
+	defer cancel()
+
+	return c.client.Publish(ctx, channel, message).Err()
+}
+
+// Subscribe subscribes to channel on a dedicated connection. It returns once
+// the server has confirmed the subscription, so no message published after
+// it returns is missed.
+func (c *GoRedisClient) Subscribe(channel string) (<-chan string, func(), error) {
+	ctx, cancel := c.context()
+	defer cancel()
+
+	pubsub := c.client.Subscribe(context.Background(), channel)
+	if _, err := pubsub.Receive(ctx); err != nil {
+		pubsub.Close()
+		return nil, nil, err
+	}
+
+	messages := make(chan string)
+	done := make(chan struct{})
+	go func() {
+		defer close(messages)
+		for message := range pubsub.Channel() {
+			select {
+			case messages <- message.Payload:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return messages, func() {
+		once.Do(func() {
+			close(done)
+			pubsub.Close()
+		})
+	}, nil
+}
+
+// Close closes the underlying connection pool.
+func (c *GoRedisClient) Close() error {
+	return c.client.Close()
+}
+
+func (c *GoRedisClient) context() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), c.timeout)
+}
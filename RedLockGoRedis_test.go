@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// respServer is an in-process stand-in for a Redis server. It speaks just
+// enough RESP to serve go-redis and answers every command through reply.
+type respServer struct {
+	listener net.Listener
+
+	mu       sync.Mutex
+	commands [][]string
+
+	// reply returns the raw RESP reply for a command.
+	reply func(args []string) string
+}
+
+func newRESPServer(t *testing.T, reply func(args []string) string) *respServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	s := &respServer{listener: listener, reply: reply}
+	go s.serve()
+	t.Cleanup(func() { listener.Close() })
+	return s
+}
+
+func (s *respServer) addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *respServer) received() [][]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([][]string(nil), s.commands...)
+}
+
+func (s *respServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *respServer) handle(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		args, err := readCommand(reader)
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.commands = append(s.commands, args)
+		s.mu.Unlock()
+
+		reply := s.reply(args)
+		if reply == "" {
+			// Never answer, so that the client times out.
+			continue
+		}
+		if _, err := io.WriteString(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+func readCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := readLine(reader)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return nil, fmt.Errorf("unexpected request %q", line)
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		header, err := readLine(reader)
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimPrefix(header, "$"))
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, buf); err != nil {
+			return nil, err
+		}
+		args = append(args, string(buf[:size]))
+	}
+	return args, nil
+}
+
+func readLine(reader *bufio.Reader) (string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func TestGoRedisClientEvalReplies(t *testing.T) {
+	replies := map[string]string{
+		"integer": ":1\r\n",
+		"zero":    ":0\r\n",
+		"nil":     "$-1\r\n",
+		"string":  "$2\r\nok\r\n",
+	}
+	server := newRESPServer(t, func(args []string) string {
+		return replies[args[1]]
+	})
+	client := NewGoRedisClient(server.addr(), time.Second)
+	defer client.Close()
+
+	tests := []struct {
+		script string
+		want   interface{}
+	}{
+		{"integer", int64(1)},
+		{"zero", int64(0)},
+		{"nil", int64(0)},
+		{"string", "ok"},
+	}
+	for _, test := range tests {
+		got, err := client.Eval(test.script, []string{"k"}, "v", 100)
+		if err != nil {
+			t.Fatalf("Eval(%s): %v", test.script, err)
+		}
+		if got != test.want {
+			t.Fatalf("Eval(%s) = %#v, want %#v", test.script, got, test.want)
+		}
+	}
+}
+
+func TestGoRedisClientGetSetDel(t *testing.T) {
+	server := newRESPServer(t, func(args []string) string {
+		switch strings.ToLower(args[0]) {
+		case "get":
+			if args[1] == "present" {
+				return "$5\r\nvalue\r\n"
+			}
+			return "$-1\r\n"
+		case "set":
+			return "+OK\r\n"
+		case "del":
+			return ":1\r\n"
+		}
+		return "-ERR unknown command\r\n"
+	})
+	client := NewGoRedisClient(server.addr(), time.Second)
+	defer client.Close()
+
+	if err := client.Set("present", "value", 1500*time.Millisecond); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	value, err := client.Get("present")
+	if err != nil || value != "value" {
+		t.Fatalf("Get(present) = %#v, %v", value, err)
+	}
+	value, err = client.Get("missing")
+	if err != nil || value != nil {
+		t.Fatalf("Get(missing) = %#v, %v; want nil, nil", value, err)
+	}
+	if err := client.Del("present"); err != nil {
+		t.Fatalf("Del: %v", err)
+	}
+
+	var set []string
+	for _, command := range server.received() {
+		if strings.EqualFold(command[0], "set") {
+			set = command
+		}
+	}
+	want := []string{"set", "present", "value", "px", "1500"}
+	if strings.Join(set, " ") != strings.Join(want, " ") {
+		t.Fatalf("SET sent as %q, want %q", set, want)
+	}
+}
+
+func TestGoRedisClientHonoursTimeout(t *testing.T) {
+	server := newRESPServer(t, func(args []string) string {
+		return ""
+	})
+	client := NewGoRedisClient(server.addr(), 50*time.Millisecond)
+	defer client.Close()
+
+	start := time.Now()
+	if _, err := client.Eval("script", []string{"k"}); err == nil {
+		t.Fatalf("Eval against a silent server succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Eval took %v, want it bounded by the 50ms timeout", elapsed)
+	}
+}
+
+func TestRedlockOverGoRedis(t *testing.T) {
+	var addrs []string
+	for i := 0; i < 3; i++ {
+		server := newRESPServer(t, func(args []string) string {
+			return ":1\r\n"
+		})
+		addrs = append(addrs, server.addr())
+	}
+	redlock := NewRedlockFromAddrs(addrs, func(r *Redlock) {
+		r.RedisConnectTimeout = 100 * time.Millisecond
+	})
+
+	lock, err := redlock.Lock("my-lock")
+	if err != nil {
+		t.Fatalf("Lock: %v", err)
+	}
+	if err := redlock.Unlock(lock); err != nil {
+		t.Fatalf("Unlock: %v", err)
+	}
+}
+
+func TestGoRedisClientPubSub(t *testing.T) {
+	server := newRESPServer(t, func(args []string) string {
+		switch strings.ToLower(args[0]) {
+		case "subscribe":
+			// Confirm the subscription and push a message right away.
+			return "*3\r\n$9\r\nsubscribe\r\n$4\r\nnews\r\n:1\r\n" +
+				"*3\r\n$7\r\nmessage\r\n$4\r\nnews\r\n$8\r\nreleased\r\n"
+		case "publish":
+			return ":1\r\n"
+		}
+		return "-ERR unknown command\r\n"
+	})
+	client := NewGoRedisClient(server.addr(), time.Second)
+	defer client.Close()
+
+	messages, cancel, err := client.Subscribe("news")
+	if err != nil {
+		t.Fatalf("Subscribe: %v", err)
+	}
+	defer cancel()
+
+	select {
+	case message := <-messages:
+		if message != "released" {
+			t.Fatalf("received %q, want %q", message, "released")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("no message received")
+	}
+
+	if err := client.Publish("news", "released"); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+}
+
+func TestRedlockOverGoRedisUsesEvalSha(t *testing.T) {
+	var mu sync.Mutex
+	loaded := make(map[string]bool)
+	var servers []*respServer
+	var addrs []string
+	for i := 0; i < 3; i++ {
+		server := newRESPServer(t, func(args []string) string {
+			mu.Lock()
+			defer mu.Unlock()
+
+			switch strings.ToLower(args[0]) {
+			case "script":
+				sha := scriptSHA(args[2])
+				loaded[sha] = true
+				return fmt.Sprintf("$%d\r\n%s\r\n", len(sha), sha)
+			case "evalsha":
+				if !loaded[args[1]] {
+					return "-NOSCRIPT No matching script. Please use EVAL.\r\n"
+				}
+				return ":1\r\n"
+			}
+			return "-ERR unexpected command\r\n"
+		})
+		servers = append(servers, server)
+		addrs = append(addrs, server.addr())
+	}
+	redlock := NewRedlockFromAddrs(addrs, func(r *Redlock) {
+		r.RedisConnectTimeout = time.Second
+	})
+
+	for i := 0; i < 2; i++ {
+		lock, err := redlock.Lock("my-lock")
+		if err != nil {
+			t.Fatalf("Lock: %v", err)
+		}
+		if err := redlock.Unlock(lock); err != nil {
+			t.Fatalf("Unlock: %v", err)
+		}
+	}
+
+	loads := 0
+	for _, server := range servers {
+		for _, command := range server.received() {
+			switch strings.ToLower(command[0]) {
+			case "eval":
+				t.Fatalf("script sent with EVAL")
+			case "script":
+				loads++
+			}
+		}
+	}
+	// The lock, fence raising and unlock scripts are loaded once per server.
+	if loads != 9 {
+		t.Fatalf("scripts loaded %d times, want 9", loads)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/saidatta/DistributedAlgorithms/locker"
+)
+
+// RedlockLocker is a locker.Locker for a single lock name of a Redlock.
+// Waiters queue fairly, so Acquire waits until the lock is free or its
+// context is done rather than following the Redlock's RetryStrategy, unless
+// the context can never be done. See LockOptions.Fair.
+type RedlockLocker struct {
+	r *Redlock
+
+	// Name is the name of the lock.
+	Name string
+
+	// TTL is the validity the lock is acquired with.
+	TTL time.Duration
+}
+
+// NewRedlockLocker creates a locker.Locker for the lock called name.
+func NewRedlockLocker(r *Redlock, name string, ttl time.Duration) *RedlockLocker {
+	return &RedlockLocker{r: r, Name: name, TTL: ttl}
+}
+
+// Acquire acquires the lock.
+func (l *RedlockLocker) Acquire(ctx context.Context) (locker.Lock, error) {
+	lock, err := l.r.LockContext(ctx, l.Name, WithFairness(), withTTL(l.TTL))
+	if err != nil {
+		return nil, err
+	}
+	return &redlockLock{r: l.r, lock: lock}, nil
+}
+
+// redlockLock is a locker.Lock held through a Redlock.
+type redlockLock struct {
+	r *Redlock
+
+	mu   sync.Mutex
+	lock *Lock
+}
+
+func (l *redlockLock) Token() uint64 {
+	return l.lock.Token
+}
+
+func (l *redlockLock) Remaining() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if remaining := l.lock.Remaining(); remaining > 0 {
+		return remaining
+	}
+	return 0
+}
+
+func (l *redlockLock) Renew(ctx context.Context, ttl time.Duration) error {
+	validity, validUntil, results, err := l.r.extend(ctx, l.lock, ttl)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return notHeld(err)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.lock.Validity, l.lock.ValidUntil, l.lock.Votes, l.lock.ttl = validity, validUntil, results, ttl
+	return nil
+}
+
+func (l *redlockLock) Release(ctx context.Context) error {
+	return notHeld(l.r.UnlockContext(ctx, l.lock))
+}
+
+// notHeld marks an error as locker.ErrNotHeld if it means that the lock is
+// no longer held: so many servers answered that they have a different value
+// set that no quorum can still have ours. Errors of servers that could not
+// be reached say nothing about the lock and are returned as they are.
+func notHeld(err error) error {
+	var quorumErr *QuorumError
+	switch {
+	case errors.Is(err, ErrValidityExpired):
+		return fmt.Errorf("%w: %v", locker.ErrNotHeld, err)
+	case errors.As(err, &quorumErr):
+		refused := 0
+		for _, result := range quorumErr.Results {
+			if result.Err == nil && !result.Voted {
+				refused++
+			}
+		}
+		if refused > len(quorumErr.Results)-quorumErr.Quorum {
+			return fmt.Errorf("%w: %v", locker.ErrNotHeld, err)
+		}
+	}
+	return err
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/saidatta/DistributedAlgorithms/locker"
+	"github.com/saidatta/DistributedAlgorithms/locker/lockertest"
+)
+
+func TestRedlockLockerConformance(t *testing.T) {
+	lockertest.Run(t, func(t *testing.T, ttl time.Duration) func() locker.Locker {
+		redlock, _ := newTestRedlock(3)
+		return func() locker.Locker {
+			return NewRedlockLocker(redlock, "resource", ttl)
+		}
+	})
+}
+
+func TestRedlockLockerUnreachableIsNotErrNotHeld(t *testing.T) {
+	redlock, fakes := newTestRedlock(3)
+	lock, err := NewRedlockLocker(redlock, "resource", time.Minute).Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+
+	for _, fake := range fakes {
+		fake.Partition()
+	}
+	if err := lock.Renew(context.Background(), time.Minute); err == nil || errors.Is(err, locker.ErrNotHeld) {
+		t.Fatalf("Renew() with no server reachable = %v, want an error other than ErrNotHeld", err)
+	}
+	if err := lock.Release(context.Background()); err == nil || errors.Is(err, locker.ErrNotHeld) {
+		t.Fatalf("Release() with no server reachable = %v, want an error other than ErrNotHeld", err)
+	}
+
+	for _, fake := range fakes {
+		fake.Heal()
+	}
+	if err := lock.Release(context.Background()); err != nil {
+		t.Fatalf("Release() once the servers are back: %v", err)
+	}
+}
+
+func TestRedlockLockerRenewHonoursContext(t *testing.T) {
+	redlock, fakes := newTestRedlock(3, func(r *Redlock) {
+		r.RedisConnectTimeout = time.Minute
+	})
+	lock, err := NewRedlockLocker(redlock, "resource", time.Minute).Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+
+	for _, fake := range fakes {
+		fake.SetLatency(time.Minute)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := lock.Renew(ctx, time.Minute); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Renew() past its deadline = %v, want context.DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Renew() took %v to notice its deadline", elapsed)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// multiLockScript sets every key in KEYS, or none of them if any is
+	// already set.
+	multiLockScript = `for i = 1, #KEYS do if redis.call('exists', KEYS[i]) == 1 then return 0 end end
+for i = 1, #KEYS do redis.call('set', KEYS[i], ARGV[1], 'px', ARGV[2]) end
+return 1`
+
+	// multiUnlockScript deletes every key in KEYS that is held with our
+	// value. It returns 1 only if all of them were.
+	multiUnlockScript = `local all = 1
+for i = 1, #KEYS do
+  if redis.call('get', KEYS[i]) == ARGV[1] then redis.call('del', KEYS[i]) else all = 0 end
+end
+return all`
+
+	// multiExtendScript resets the TTL of every key in KEYS if all of them
+	// are still held with our value.
+	multiExtendScript = `for i = 1, #KEYS do if redis.call('get', KEYS[i]) ~= ARGV[1] then return 0 end end
+for i = 1, #KEYS do redis.call('pexpire', KEYS[i], ARGV[2]) end
+return 1`
+)
+
+// MultiLock is a lock on several resources that were acquired together. Its
+// Name is the comma-separated list of Names.
+type MultiLock struct {
+	*Lock
+
+	// Names are the names of the locked resources in lock order.
+	Names []string
+
+	r *Redlock
+}
+
+// ErrNoLockNames is returned by LockMulti for an empty list of names.
+var ErrNoLockNames = errors.New("no resources to lock")
+
+// LockMulti acquires locks on all of the named resources at once.
+func (r *Redlock) LockMulti(names []string, opts ...func(*LockOptions)) (*MultiLock, error) {
+	return r.LockMultiContext(context.Background(), names, opts...)
+}
+
+// LockMultiContext acquires locks on all of the named resources at once. On
+// every server either all or none of the resources are locked, in a single
+// script, and the quorum is counted over the whole set, so a caller never
+// holds part of it. The names are sorted first so that every caller locks
+// them in the same order, and repeated names are locked once. It gives up as
+// soon as ctx is done and returns ctx.Err(). It returns ErrNoLockNames if
+// names is empty.
+func (r *Redlock) LockMultiContext(ctx context.Context, names []string, opts ...func(*LockOptions)) (*MultiLock, error) {
+	if len(names) == 0 {
+		return nil, ErrNoLockNames
+	}
+
+	options := &LockOptions{
+		Validity: time.Second,
+	}
+
+	for _, opt := range opts {
+		opt(options)
+	}
+
+	keys := sortedUnique(names)
+	lock := &Lock{
+		Name:      strings.Join(keys, ","),
+		Value:     generateUUID(),
+		Validity:  options.Validity,
+		Timestamp: time.Now().UnixNano() / int64(time.Millisecond),
+		keys:      keys,
+	}
+
+	_, err := r.acquire(ctx, lock, options.Validity, lockRequest{
+		op: "acquire locks",
+		acquire: func(server RedisClient) (int64, error) {
+			return evalInt(server, multiLockScript, keys, lock.Value, int(options.Validity/time.Millisecond))
+		},
+		release: func(server RedisClient) (int64, error) {
+			return lockReleased(server, lock)
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &MultiLock{Lock: lock, Names: keys, r: r}, nil
+}
+
+// Unlock releases all resources of the lock.
+func (m *MultiLock) Unlock() error {
+	return m.r.Unlock(m.Lock)
+}
+
+// Extend resets the TTL of all resources of the lock to ttl.
+func (m *MultiLock) Extend(ttl time.Duration) error {
+	return m.r.Extend(m.Lock, ttl)
+}
+
+func sortedUnique(names []string) []string {
+	sorted := append([]string(nil), names...)
+	sort.Strings(sorted)
+
+	unique := sorted[:0]
+	for i, name := range sorted {
+		if i == 0 || name != sorted[i-1] {
+			unique = append(unique, name)
+		}
+	}
+	return unique
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLockMultiIsAllOrNothing(t *testing.T) {
+	redlock, fakes := newTestRedlock(3)
+
+	single, err := redlock.Lock("b")
+	if err != nil {
+		t.Fatalf("Lock(b): %v", err)
+	}
+	if _, err := redlock.LockMulti([]string{"c", "b", "a"}); err == nil {
+		t.Fatalf("LockMulti succeeded while b is held")
+	}
+	for i, fake := range fakes {
+		for _, name := range []string{"a", "c"} {
+			if value, _ := fake.Get(name); value != nil {
+				t.Fatalf("server %d holds %s after a failed LockMulti", i, name)
+			}
+		}
+	}
+
+	if err := redlock.Unlock(single); err != nil {
+		t.Fatalf("Unlock(b): %v", err)
+	}
+	multi, err := redlock.LockMulti([]string{"c", "b", "a", "b"})
+	if err != nil {
+		t.Fatalf("LockMulti: %v", err)
+	}
+	if got := multi.Name; got != "a,b,c" {
+		t.Fatalf("Name = %q, want the sorted, deduplicated names", got)
+	}
+	if _, err := redlock.Lock("c"); err == nil {
+		t.Fatalf("Lock(c) succeeded while the multi-lock holds it")
+	}
+
+	if err := multi.Unlock(); err != nil {
+		t.Fatalf("Unlock: %v", err)
+	}
+	for _, name := range multi.Names {
+		if _, err := redlock.Lock(name); err != nil {
+			t.Fatalf("Lock(%s) after the multi-lock was released: %v", name, err)
+		}
+	}
+}
+
+func TestMultiLockExtend(t *testing.T) {
+	redlock, _ := newTestRedlock(3)
+
+	multi, err := redlock.LockMultiContext(context.Background(), []string{"a", "b"}, withValidity(40*time.Millisecond))
+	if err != nil {
+		t.Fatalf("LockMultiContext: %v", err)
+	}
+	if err := multi.Extend(time.Minute); err != nil {
+		t.Fatalf("Extend: %v", err)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if _, err := redlock.Lock("b"); err == nil {
+		t.Fatalf("Lock(b) succeeded after the multi-lock was extended")
+	}
+	if err := multi.Unlock(); err != nil {
+		t.Fatalf("Unlock after Extend: %v", err)
+	}
+}
+
+func TestLockMultiRejectsNoNames(t *testing.T) {
+	redlock, _ := newTestRedlock(3)
+
+	for _, names := range [][]string{nil, {}} {
+		if _, err := redlock.LockMulti(names); !errors.Is(err, ErrNoLockNames) {
+			t.Fatalf("LockMulti(%q) = %v, want ErrNoLockNames", names, err)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import "time"
+
+// ObserverEventKind is the kind of an ObserverEvent.
+type ObserverEventKind int
+
+const (
+	// ServerCallEvent reports how a single server answered a request.
+	ServerCallEvent ObserverEventKind = iota
+
+	// QuorumEvent reports the outcome of a quorum round.
+	QuorumEvent
+
+	// RetryEvent reports that a failed attempt is about to be retried.
+	RetryEvent
+
+	// DriftAbortEvent reports an acquisition that reached a quorum but was
+	// given up because the time it took and the clock drift allowance used
+	// up the lock's validity.
+	DriftAbortEvent
+
+	// UnlockFailureEvent reports a lock that could not be released on a
+	// quorum of servers.
+	UnlockFailureEvent
+)
+
+// String returns the name of the kind.
+func (k ObserverEventKind) String() string {
+	switch k {
+	case ServerCallEvent:
+		return "server call"
+	case QuorumEvent:
+		return "quorum"
+	case RetryEvent:
+		return "retry"
+	case DriftAbortEvent:
+		return "drift abort"
+	case UnlockFailureEvent:
+		return "unlock failure"
+	}
+	return "unknown"
+}
+
+// ObserverEvent is an event in the life of a lock. Which fields are set
+// depends on the Kind.
+type ObserverEvent struct {
+	// Kind is the kind of the event.
+	Kind ObserverEventKind
+
+	// Op names the request, e.g. "acquire lock" or "release lock".
+	Op string
+
+	// Name is the name of the lock.
+	Name string
+
+	// Result is the outcome on a single server, for ServerCallEvents.
+	Result ServerResult
+
+	// Votes is the number of servers that granted the request and Quorum
+	// the number required, for QuorumEvents.
+	Votes  int
+	Quorum int
+
+	// Success is true for a QuorumEvent of a round that reached a quorum
+	// within the lock's validity.
+	Success bool
+
+	// Elapsed is the duration of the round, for QuorumEvents and
+	// DriftAbortEvents.
+	Elapsed time.Duration
+
+	// Attempt is the number of attempts made so far and Delay the wait
+	// before the next one, for RetryEvents.
+	Attempt int
+	Delay   time.Duration
+
+	// Err is the error of an UnlockFailureEvent.
+	Err error
+}
+
+// Observer receives the events of a Redlock. Observe is called
+// synchronously from the goroutines acquiring and releasing locks, so it
+// must be safe for concurrent use and return quickly.
+type Observer interface {
+	Observe(event ObserverEvent)
+}
+
+// ObserverFunc adapts a function to an Observer.
+type ObserverFunc func(event ObserverEvent)
+
+// Observe calls f(event).
+func (f ObserverFunc) Observe(event ObserverEvent) {
+	f(event)
+}
+
+// WithObserver makes the Redlock report its events to observer.
+func WithObserver(observer Observer) func(*Redlock) {
+	return func(r *Redlock) {
+		r.observer = observer
+	}
+}
+
+func (r *Redlock) observe(event ObserverEvent) {
+	if r.observer != nil {
+		r.observer.Observe(event)
+	}
+}
+
+// observeRound reports the per-server results of a round and its outcome.
+func (r *Redlock) observeRound(op, name string, results []ServerResult, success bool, elapsed time.Duration) {
+	if r.observer == nil {
+		return
+	}
+
+	votes := 0
+	for _, result := range results {
+		if result.Voted {
+			votes++
+		}
+		r.observer.Observe(ObserverEvent{Kind: ServerCallEvent, Op: op, Name: name, Result: result})
+	}
+	r.observer.Observe(ObserverEvent{
+		Kind:    QuorumEvent,
+		Op:      op,
+		Name:    name,
+		Votes:   votes,
+		Quorum:  r.quorum,
+		Success: success,
+		Elapsed: elapsed,
+	})
+}
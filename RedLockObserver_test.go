@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingObserver collects the events it observes.
+type recordingObserver struct {
+	mu     sync.Mutex
+	events []ObserverEvent
+}
+
+func (o *recordingObserver) Observe(event ObserverEvent) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.events = append(o.events, event)
+}
+
+func (o *recordingObserver) count(kind ObserverEventKind) int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	n := 0
+	for _, event := range o.events {
+		if event.Kind == kind {
+			n++
+		}
+	}
+	return n
+}
+
+func TestObserverEvents(t *testing.T) {
+	observer := &recordingObserver{}
+	redlock, fakes := newTestRedlock(3, WithObserver(observer), WithRetryStrategy(FixedRetry(2, 0)))
+
+	fakes[1].Set("my-lock", "someone-else", time.Minute)
+	fakes[2].Set("my-lock", "someone-else", time.Minute)
+	if _, err := redlock.Lock("my-lock"); err == nil {
+		t.Fatalf("Lock succeeded while a majority is held by someone else")
+	}
+	if n := observer.count(QuorumEvent); n != 2 {
+		t.Fatalf("observed %d quorum rounds, want 2", n)
+	}
+	if n := observer.count(ServerCallEvent); n != 6 {
+		t.Fatalf("observed %d server calls, want 6", n)
+	}
+	if n := observer.count(RetryEvent); n != 1 {
+		t.Fatalf("observed %d retries, want 1", n)
+	}
+
+	fakes[1].Del("my-lock")
+	fakes[2].Del("my-lock")
+	lock, err := redlock.Lock("my-lock")
+	if err != nil {
+		t.Fatalf("Lock: %v", err)
+	}
+	for _, fake := range fakes {
+		fake.SetError(errors.New("boom"))
+	}
+	if err := redlock.Unlock(lock); err == nil {
+		t.Fatalf("Unlock with all servers failing succeeded")
+	}
+	if n := observer.count(UnlockFailureEvent); n != 1 {
+		t.Fatalf("observed %d unlock failures, want 1", n)
+	}
+}
+
+func TestObserverDriftAbort(t *testing.T) {
+	observer := &recordingObserver{}
+	redlock, fakes := newTestRedlock(3, WithObserver(observer))
+	for _, fake := range fakes {
+		fake.SetLatency(20 * time.Millisecond)
+	}
+
+	if _, err := redlock.Lock("my-lock", withValidity(10*time.Millisecond)); err != ErrValidityExpired {
+		t.Fatalf("Lock = %v, want %v", err, ErrValidityExpired)
+	}
+	if n := observer.count(DriftAbortEvent); n != 1 {
+		t.Fatalf("observed %d drift aborts, want 1", n)
+	}
+}
+
+func TestPrometheusObserver(t *testing.T) {
+	observer := NewPrometheusObserver()
+	redlock, fakes := newTestRedlock(3, WithObserver(observer))
+	fakes[2].SetError(errors.New("boom"))
+
+	lock, err := redlock.Lock("my-lock")
+	if err != nil {
+		t.Fatalf("Lock: %v", err)
+	}
+	if err := redlock.Unlock(lock); err != nil {
+		t.Fatalf("Unlock: %v", err)
+	}
+
+	server := httptest.NewServer(observer)
+	defer server.Close()
+	resp, err := server.Client().Get(server.URL)
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("reading metrics: %v", err)
+	}
+
+	for _, want := range []string{
+		"# TYPE redlock_server_requests_total counter\n",
+		`redlock_rounds_total{op="acquire lock",outcome="success"} 1` + "\n",
+		`redlock_rounds_total{op="release lock",outcome="success"} 1` + "\n",
+		`redlock_server_request_seconds_count{op="acquire lock",server="0"} 1` + "\n",
+		`redlock_round_seconds_bucket{op="acquire lock",le="+Inf"} 1` + "\n",
+		"redlock_unlock_failures_total 0\n",
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Fatalf("metrics do not contain %q:\n%s", want, body)
+		}
+	}
+	if !strings.Contains(string(body), `server="2",result="error"}`) && !strings.Contains(string(body), `server="2",result="not_awaited"}`) {
+		t.Fatalf("metrics do not report the failing server:\n%s", body)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// latencyBuckets are the upper bounds, in seconds, of the latency
+// histograms. They cover a fast local round trip up to RedisConnectTimeout.
+var latencyBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5}
+
+// PrometheusObserver is an Observer that keeps counters and histograms of a
+// Redlock's events and serves them in the Prometheus text format:
+//
+//	redlock_server_requests_total{op,server,result}   counter
+//	redlock_server_request_seconds{op,server}         histogram
+//	redlock_rounds_total{op,outcome}                  counter
+//	redlock_round_seconds{op}                         histogram
+//	redlock_retries_total{op}                         counter
+//	redlock_drift_aborts_total{op}                    counter
+//	redlock_unlock_failures_total                     counter
+//
+// result is "voted", "rejected", "timeout", "not_awaited" or "error", and
+// outcome is "success" or "failure". Lock names are not used as labels
+// since there may be arbitrarily many of them.
+type PrometheusObserver struct {
+	mu sync.Mutex
+
+	serverRequests map[string]float64
+	serverLatency  map[string]*histogram
+	rounds         map[string]float64
+	roundLatency   map[string]*histogram
+	retries        map[string]float64
+	driftAborts    map[string]float64
+	unlockFailures float64
+}
+
+// NewPrometheusObserver creates a PrometheusObserver with all counters at
+// zero. Pass it to WithObserver and serve it, e.g. with
+// http.Handle("/metrics", observer).
+func NewPrometheusObserver() *PrometheusObserver {
+	return &PrometheusObserver{
+		serverRequests: make(map[string]float64),
+		serverLatency:  make(map[string]*histogram),
+		rounds:         make(map[string]float64),
+		roundLatency:   make(map[string]*histogram),
+		retries:        make(map[string]float64),
+		driftAborts:    make(map[string]float64),
+	}
+}
+
+// Observe records event.
+func (p *PrometheusObserver) Observe(event ObserverEvent) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	switch event.Kind {
+	case ServerCallEvent:
+		server := strconv.Itoa(event.Result.Server)
+		p.serverRequests[labels("op", event.Op, "server", server, "result", serverOutcome(event.Result))]++
+		if !errors.Is(event.Result.Err, ErrNotAwaited) {
+			observeHistogram(p.serverLatency, labels("op", event.Op, "server", server), event.Result.Latency.Seconds())
+		}
+	case QuorumEvent:
+		outcome := "failure"
+		if event.Success {
+			outcome = "success"
+		}
+		p.rounds[labels("op", event.Op, "outcome", outcome)]++
+		observeHistogram(p.roundLatency, labels("op", event.Op), event.Elapsed.Seconds())
+	case RetryEvent:
+		p.retries[labels("op", event.Op)]++
+	case DriftAbortEvent:
+		p.driftAborts[labels("op", event.Op)]++
+	case UnlockFailureEvent:
+		p.unlockFailures++
+	}
+}
+
+// ServeHTTP writes all metrics in the Prometheus text format.
+func (p *PrometheusObserver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	p.WriteTo(w)
+}
+
+// WriteTo writes all metrics in the Prometheus text format to w.
+func (p *PrometheusObserver) WriteTo(w io.Writer) (int64, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var b strings.Builder
+	writeCounters(&b, "redlock_server_requests_total", "Requests sent to each server by outcome.", p.serverRequests)
+	writeHistograms(&b, "redlock_server_request_seconds", "Latency of the requests sent to each server.", p.serverLatency)
+	writeCounters(&b, "redlock_rounds_total", "Quorum rounds by outcome.", p.rounds)
+	writeHistograms(&b, "redlock_round_seconds", "Duration of quorum rounds.", p.roundLatency)
+	writeCounters(&b, "redlock_retries_total", "Failed attempts that were retried.", p.retries)
+	writeCounters(&b, "redlock_drift_aborts_total", "Quorums given up because the lock's validity ran out.", p.driftAborts)
+	writeCounters(&b, "redlock_unlock_failures_total", "Locks that could not be released on a quorum.", map[string]float64{"": p.unlockFailures})
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// histogram is a Prometheus histogram over latencyBuckets.
+type histogram struct {
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+func observeHistogram(histograms map[string]*histogram, key string, value float64) {
+	h, ok := histograms[key]
+	if !ok {
+		h = &histogram{buckets: make([]uint64, len(latencyBuckets))}
+		histograms[key] = h
+	}
+	for i, bound := range latencyBuckets {
+		if value <= bound {
+			h.buckets[i]++
+		}
+	}
+	h.count++
+	h.sum += value
+}
+
+func serverOutcome(result ServerResult) string {
+	switch {
+	case result.Voted:
+		return "voted"
+	case result.Err == nil:
+		return "rejected"
+	case errors.Is(result.Err, ErrServerTimeout):
+		return "timeout"
+	case errors.Is(result.Err, ErrNotAwaited):
+		return "not_awaited"
+	}
+	return "error"
+}
+
+// labels renders label pairs as they appear between the braces of a series,
+// e.g. op="acquire lock",server="0".
+func labels(pairs ...string) string {
+	rendered := make([]string, 0, len(pairs)/2)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		rendered = append(rendered, fmt.Sprintf("%s=%s", pairs[i], strconv.Quote(pairs[i+1])))
+	}
+	return strings.Join(rendered, ",")
+}
+
+func writeCounters(b *strings.Builder, name, help string, counters map[string]float64) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+	keys := make([]string, 0, len(counters))
+	for key := range counters {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		fmt.Fprintf(b, "%s%s %s\n", name, braces(key), formatFloat(counters[key]))
+	}
+}
+
+func writeHistograms(b *strings.Builder, name, help string, histograms map[string]*histogram) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	keys := make([]string, 0, len(histograms))
+	for key := range histograms {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		h := histograms[key]
+		prefix := key
+		if prefix != "" {
+			prefix += ","
+		}
+		for i, bound := range latencyBuckets {
+			fmt.Fprintf(b, "%s_bucket{%sle=%q} %d\n", name, prefix, formatFloat(bound), h.buckets[i])
+		}
+		fmt.Fprintf(b, "%s_bucket{%sle=\"+Inf\"} %d\n", name, prefix, h.count)
+		fmt.Fprintf(b, "%s_sum%s %s\n", name, braces(key), formatFloat(h.sum))
+		fmt.Fprintf(b, "%s_count%s %d\n", name, braces(key), h.count)
+	}
+}
+
+func braces(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
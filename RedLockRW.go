@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	// rwReadLockScript adds a reader with its own expiry, measured on the
+	// server's clock, unless a writer holds or is waiting for the lock.
+	// KEYS are the writer, readers and writer intent keys.
+	rwReadLockScript = `local t = redis.call('time')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+if redis.call('exists', KEYS[1]) == 1 or redis.call('exists', KEYS[3]) == 1 then return 0 end
+redis.call('zadd', KEYS[2], now + tonumber(ARGV[2]), ARGV[1])
+if redis.call('pttl', KEYS[2]) < tonumber(ARGV[2]) then redis.call('pexpire', KEYS[2], ARGV[2]) end
+return 1`
+
+	// rwReadUnlockScript removes a single reader.
+	rwReadUnlockScript = "return redis.call('zrem', KEYS[1], ARGV[1])"
+
+	// rwWriteLockScript takes the writer key once expired readers have been
+	// dropped and no reader is left. While readers remain it records the
+	// writer's intent, which keeps new readers out so that writers are not
+	// starved. KEYS are the writer, readers and writer intent keys.
+	rwWriteLockScript = `local t = redis.call('time')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+redis.call('zremrangebyscore', KEYS[2], '-inf', now)
+if redis.call('exists', KEYS[1]) == 1 then return 0 end
+local intent = redis.call('get', KEYS[3])
+if intent and intent ~= ARGV[1] then return 0 end
+if redis.call('zcard', KEYS[2]) > 0 then
+  redis.call('set', KEYS[3], ARGV[1], 'px', ARGV[2])
+  return 0
+end
+redis.call('set', KEYS[1], ARGV[1], 'px', ARGV[2])
+redis.call('del', KEYS[3])
+return 1`
+
+	// rwWriteUnlockScript deletes the writer key and withdraws the writer's
+	// intent, each only if it is held with our value. KEYS are the writer and
+	// writer intent keys.
+	rwWriteUnlockScript = `if redis.call('get', KEYS[2]) == ARGV[1] then redis.call('del', KEYS[2]) end
+if redis.call('get', KEYS[1]) == ARGV[1] then return redis.call('del', KEYS[1]) end
+return 0`
+)
+
+// RWRedlock is a distributed read/write lock built on Redlock. Any number of
+// readers can hold a resource at the same time, each with its own TTL, while
+// a writer holds it exclusively. A waiting writer keeps new readers out.
+type RWRedlock struct {
+	r *Redlock
+}
+
+// NewRWRedlock creates a read/write lock manager that uses the servers,
+// quorum and retry strategy of r.
+func NewRWRedlock(r *Redlock) *RWRedlock {
+	return &RWRedlock{r: r}
+}
+
+// RLock acquires a read lock on the named resource.
+func (rw *RWRedlock) RLock(name string, opts ...func(*LockOptions)) (*Lock, error) {
+	return rw.RLockContext(context.Background(), name, opts...)
+}
+
+// RLockContext acquires a read lock on the named resource. It gives up as
+// soon as ctx is done and returns ctx.Err().
+func (rw *RWRedlock) RLockContext(ctx context.Context, name string, opts ...func(*LockOptions)) (*Lock, error) {
+	lock, ttl := newRWLock(name, opts)
+	lock.reader = true
+	return rw.r.acquire(ctx, lock, ttl, lockRequest{
+		op: "acquire read lock",
+		acquire: func(server RedisClient) (int64, error) {
+			return evalInt(server, rwReadLockScript, rwKeys(name), lock.Value, int(ttl/time.Millisecond))
+		},
+		release: func(server RedisClient) (int64, error) {
+			return readLockReleased(server, lock)
+		},
+	})
+}
+
+// RUnlock releases a read lock without affecting other readers.
+func (rw *RWRedlock) RUnlock(lock *Lock) error {
+	return rw.r.Unlock(lock)
+}
+
+// Lock acquires the write lock on the named resource.
+func (rw *RWRedlock) Lock(name string, opts ...func(*LockOptions)) (*Lock, error) {
+	return rw.LockContext(context.Background(), name, opts...)
+}
+
+// LockContext acquires the write lock on the named resource. It gives up as
+// soon as ctx is done and returns ctx.Err(). The lock is named after the
+// writer key, so that it can be extended and kept alive like any other lock.
+func (rw *RWRedlock) LockContext(ctx context.Context, name string, opts ...func(*LockOptions)) (*Lock, error) {
+	lock, ttl := newRWLock(name, opts)
+	keys := rwKeys(name)
+	lock.Name = keys[0]
+	lock.intent = keys[2]
+
+	// Failed attempts only give up the writer key. The intent is kept while
+	// retrying so that readers stay out until the writer gets its turn.
+	attempt := &Lock{Name: keys[0], Value: lock.Value}
+	acquired, err := rw.r.acquire(ctx, lock, ttl, lockRequest{
+		op: "acquire write lock",
+		acquire: func(server RedisClient) (int64, error) {
+			return evalInt(server, rwWriteLockScript, keys, lock.Value, int(ttl/time.Millisecond))
+		},
+		release: func(server RedisClient) (int64, error) {
+			return lockReleased(server, attempt)
+		},
+	})
+	if err != nil {
+		// Withdraw the intent so that readers need not wait for it to expire.
+		rw.r.broadcast(context.Background(), func(server RedisClient) (int64, error) {
+			return lockReleased(server, lock)
+		})
+		return nil, err
+	}
+	return acquired, nil
+}
+
+// Unlock releases the write lock and withdraws the writer's intent on servers
+// where readers kept it from taking the writer key.
+func (rw *RWRedlock) Unlock(lock *Lock) error {
+	return rw.r.Unlock(lock)
+}
+
+func newRWLock(name string, opts []func(*LockOptions)) (*Lock, time.Duration) {
+	options := &LockOptions{
+		Validity: time.Second,
+	}
+
+	for _, opt := range opts {
+		opt(options)
+	}
+
+	return &Lock{
+		Name:      name,
+		Value:     generateUUID(),
+		Validity:  options.Validity,
+		Timestamp: time.Now().UnixNano() / int64(time.Millisecond),
+	}, options.Validity
+}
+
+// rwKeys returns the writer, readers and writer intent keys of a resource.
+func rwKeys(name string) []string {
+	return []string{name + ":writer", name + ":readers", name + ":writer-intent"}
+}
+
+func readLockReleased(client RedisClient, lock *Lock) (int64, error) {
+	return evalInt(client, rwReadUnlockScript, rwKeys(lock.Name)[1:2], lock.Value)
+}
+
+func writeLockReleased(client RedisClient, lock *Lock) (int64, error) {
+	return evalInt(client, rwWriteUnlockScript, []string{lock.Name, lock.intent}, lock.Value)
+}
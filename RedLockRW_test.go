@@ -0,0 +1,178 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRWRedlockReadersShare(t *testing.T) {
+	redlock, _ := newTestRedlock(3)
+	rw := NewRWRedlock(redlock)
+
+	first, err := rw.RLock("doc")
+	if err != nil {
+		t.Fatalf("RLock(first): %v", err)
+	}
+	second, err := rw.RLock("doc")
+	if err != nil {
+		t.Fatalf("RLock(second): %v", err)
+	}
+	if _, err := rw.Lock("doc"); err == nil {
+		t.Fatalf("writer acquired the lock while readers hold it")
+	}
+
+	// Releasing one reader leaves the other in place.
+	if err := rw.RUnlock(first); err != nil {
+		t.Fatalf("RUnlock(first): %v", err)
+	}
+	if _, err := rw.Lock("doc"); err == nil {
+		t.Fatalf("writer acquired the lock while a reader still holds it")
+	}
+
+	if err := rw.RUnlock(second); err != nil {
+		t.Fatalf("RUnlock(second): %v", err)
+	}
+	writer, err := rw.Lock("doc")
+	if err != nil {
+		t.Fatalf("Lock after all readers left: %v", err)
+	}
+	if _, err := rw.RLock("doc"); err == nil {
+		t.Fatalf("reader acquired the lock while a writer holds it")
+	}
+	if err := rw.Unlock(writer); err != nil {
+		t.Fatalf("Unlock: %v", err)
+	}
+	if _, err := rw.RLock("doc"); err != nil {
+		t.Fatalf("RLock after the writer left: %v", err)
+	}
+}
+
+func TestRWRedlockExpiredReaderDoesNotBlockWriter(t *testing.T) {
+	redlock, _ := newTestRedlock(3)
+	rw := NewRWRedlock(redlock)
+
+	if _, err := rw.RLock("doc", withValidity(30*time.Millisecond)); err != nil {
+		t.Fatalf("RLock(short): %v", err)
+	}
+	long, err := rw.RLock("doc", withValidity(time.Minute))
+	if err != nil {
+		t.Fatalf("RLock(long): %v", err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if err := rw.RUnlock(long); err != nil {
+		t.Fatalf("RUnlock(long): %v", err)
+	}
+	if _, err := rw.Lock("doc"); err != nil {
+		t.Fatalf("Lock with only an expired reader left: %v", err)
+	}
+}
+
+func TestRWRedlockWriterPreference(t *testing.T) {
+	redlock, _ := newTestRedlock(3, WithRetryStrategy(FixedRetry(50, 5*time.Millisecond)))
+	rw := NewRWRedlock(redlock)
+
+	reader, err := rw.RLock("doc")
+	if err != nil {
+		t.Fatalf("RLock: %v", err)
+	}
+
+	acquired := make(chan error, 1)
+	go func() {
+		_, err := rw.Lock("doc")
+		acquired <- err
+	}()
+
+	// Once the writer is waiting, new readers are turned away.
+	time.Sleep(20 * time.Millisecond)
+	impatient := NewRWRedlock(NewRedlock(redlock.servers, WithRetryStrategy(FixedRetry(1, 0))))
+	if _, err := impatient.RLock("doc"); err == nil {
+		t.Fatalf("reader overtook a waiting writer")
+	}
+
+	if err := rw.RUnlock(reader); err != nil {
+		t.Fatalf("RUnlock: %v", err)
+	}
+	if err := <-acquired; err != nil {
+		t.Fatalf("waiting writer did not get the lock: %v", err)
+	}
+}
+
+func TestRWRedlockWriterCanBeExtended(t *testing.T) {
+	redlock, fakes := newTestRedlock(3)
+	rw := NewRWRedlock(redlock)
+
+	writer, err := rw.Lock("doc", withValidity(time.Second))
+	if err != nil {
+		t.Fatalf("Lock: %v", err)
+	}
+	if err := redlock.Extend(writer, time.Minute); err != nil {
+		t.Fatalf("Extend: %v", err)
+	}
+	extended := 0
+	for _, fake := range fakes {
+		reply, err := fake.Eval(inspectScript, []string{"doc:writer"})
+		if err == nil && reply.([]interface{})[1].(int64) > int64(time.Second/time.Millisecond) {
+			extended++
+		}
+	}
+	if extended < 2 {
+		t.Fatalf("writer key extended on %d servers, want a quorum", extended)
+	}
+
+	if err := rw.Unlock(writer); err != nil {
+		t.Fatalf("Unlock: %v", err)
+	}
+	if _, err := rw.RLock("doc"); err != nil {
+		t.Fatalf("RLock after the writer left: %v", err)
+	}
+}
+
+func TestRWRedlockUnlockWithdrawsIntent(t *testing.T) {
+	redlock, fakes := newTestRedlock(3)
+	rw := NewRWRedlock(redlock)
+
+	// A reader only one server knows about leaves the writer an intent
+	// there, while the other two servers give it the writer key.
+	if _, err := fakes[2].Eval(rwReadLockScript, rwKeys("doc"), "stray", 60000); err != nil {
+		t.Fatalf("stray reader: %v", err)
+	}
+	// The round ends with the quorum, so the intent must be set before then.
+	fakes[0].SetLatency(10 * time.Millisecond)
+	fakes[1].SetLatency(10 * time.Millisecond)
+	writer, err := rw.Lock("doc")
+	if err != nil {
+		t.Fatalf("Lock: %v", err)
+	}
+	if value, _ := fakes[2].Get("doc:writer-intent"); value == nil {
+		t.Fatalf("writer left no intent next to the stray reader")
+	}
+
+	if err := rw.Unlock(writer); err != nil {
+		t.Fatalf("Unlock: %v", err)
+	}
+	if value, _ := fakes[2].Get("doc:writer-intent"); value != nil {
+		t.Fatalf("intent %v outlived the write lock", value)
+	}
+}
+
+func TestRWRedlockRUnlockFailureIsObserved(t *testing.T) {
+	observer := &recordingObserver{}
+	redlock, fakes := newTestRedlock(3, WithObserver(observer))
+	rw := NewRWRedlock(redlock)
+
+	reader, err := rw.RLock("doc")
+	if err != nil {
+		t.Fatalf("RLock: %v", err)
+	}
+	for _, fake := range fakes {
+		fake.SetError(errors.New("boom"))
+	}
+	if err := rw.RUnlock(reader); err == nil {
+		t.Fatalf("RUnlock with all servers failing succeeded")
+	}
+	if n := observer.count(UnlockFailureEvent); n != 1 {
+		t.Fatalf("observed %d unlock failures, want 1", n)
+	}
+}
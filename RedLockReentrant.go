@@ -0,0 +1,73 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+)
+
+const (
+	// reentrantLockScript takes a free lock with a single hold, or adds a
+	// hold if the lock is already held by the same owner. Re-entry only ever
+	// lengthens the TTL, so that a short inner hold cannot cut the outer one
+	// short. KEYS are the lock, holds and fencing counter keys; ARGV are the
+	// owner, the TTL and the id of the hold. It returns the fencing counter,
+	// which a fresh acquisition increments.
+	reentrantLockScript = `local v = redis.call('get', KEYS[1])
+if v == false then
+  redis.call('set', KEYS[1], ARGV[1], 'px', ARGV[2])
+  redis.call('del', KEYS[2])
+  redis.call('sadd', KEYS[2], ARGV[3])
+  redis.call('pexpire', KEYS[2], ARGV[2])
+  return redis.call('incr', KEYS[3])
+end
+if v ~= ARGV[1] then return 0 end
+redis.call('sadd', KEYS[2], ARGV[3])
+local ttl = math.max(redis.call('pttl', KEYS[1]), tonumber(ARGV[2]))
+redis.call('pexpire', KEYS[1], ttl)
+redis.call('pexpire', KEYS[2], ttl)
+return math.max(1, tonumber(redis.call('get', KEYS[3]) or '1'))`
+
+	// reentrantUnlockScript drops a hold of the owner and deletes the lock
+	// once no holds are left. KEYS are the lock and holds keys; ARGV are the
+	// owner and the id of the hold. Dropping a hold that the server never
+	// granted changes nothing, so a failed attempt can be rolled back on
+	// every server.
+	reentrantUnlockScript = `if redis.call('get', KEYS[1]) ~= ARGV[1] then return 0 end
+if redis.call('srem', KEYS[2], ARGV[2]) == 0 then return 0 end
+if redis.call('scard', KEYS[2]) == 0 then redis.call('del', KEYS[1], KEYS[2]) end
+return 1`
+)
+
+// WithOwner makes a lock reentrant for owner. See LockOptions.Owner.
+func WithOwner(owner string) func(*LockOptions) {
+	return func(options *LockOptions) {
+		options.Owner = owner
+	}
+}
+
+// ownerPrefix identifies this process in owner IDs.
+var ownerPrefix = func() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s:%d", host, os.Getpid())
+}()
+
+// NewOwnerID creates an owner identity of the form host:pid:random. The host
+// and process id tell holders apart when inspecting a lock, and the 128
+// random bits make the identity impossible to guess.
+func NewOwnerID() string {
+	var random [16]byte
+	if _, err := rand.Read(random[:]); err != nil {
+		panic(fmt.Sprintf("redlock: unable to read random bytes: %v", err))
+	}
+	return ownerPrefix + ":" + hex.EncodeToString(random[:])
+}
+
+// holdsKey returns the key holding the set of holds of a reentrant lock.
+func holdsKey(name string) string {
+	return name + ":holds"
+}
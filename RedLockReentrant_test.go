@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReentrantLock(t *testing.T) {
+	redlock, _ := newTestRedlock(3)
+	owner := NewOwnerID()
+
+	outer, err := redlock.Lock("my-lock", WithOwner(owner))
+	if err != nil {
+		t.Fatalf("Lock(outer): %v", err)
+	}
+	inner, err := redlock.Lock("my-lock", WithOwner(owner))
+	if err != nil {
+		t.Fatalf("Lock(inner) by the same owner: %v", err)
+	}
+	// Re-entry does not draw a new token. It may still report a larger one
+	// if an outer request the quorum did not wait for bumped the counter late.
+	if inner.Token < outer.Token {
+		t.Fatalf("re-entry lowered the fencing token from %d to %d", outer.Token, inner.Token)
+	}
+	if _, err := redlock.Lock("my-lock", WithOwner(NewOwnerID())); err == nil {
+		t.Fatalf("another owner acquired a held lock")
+	}
+
+	if err := redlock.Unlock(inner); err != nil {
+		t.Fatalf("Unlock(inner): %v", err)
+	}
+	if _, err := redlock.Lock("my-lock"); err == nil {
+		t.Fatalf("lock was freed while the outer hold remains")
+	}
+
+	if err := redlock.Unlock(outer); err != nil {
+		t.Fatalf("Unlock(outer): %v", err)
+	}
+	if _, err := redlock.Lock("my-lock"); err != nil {
+		t.Fatalf("Lock after the last hold was released: %v", err)
+	}
+}
+
+func TestReentrantLockExtendKeepsHolds(t *testing.T) {
+	redlock, _ := newTestRedlock(3)
+	owner := NewOwnerID()
+
+	outer, err := redlock.Lock("my-lock", WithOwner(owner), withValidity(50*time.Millisecond))
+	if err != nil {
+		t.Fatalf("Lock(outer): %v", err)
+	}
+	inner, err := redlock.Lock("my-lock", WithOwner(owner), withValidity(50*time.Millisecond))
+	if err != nil {
+		t.Fatalf("Lock(inner): %v", err)
+	}
+	if err := redlock.Extend(outer, time.Minute); err != nil {
+		t.Fatalf("Extend: %v", err)
+	}
+
+	time.Sleep(70 * time.Millisecond)
+	if err := redlock.Unlock(inner); err != nil {
+		t.Fatalf("Unlock(inner) after the original TTL: %v", err)
+	}
+	if _, err := redlock.Lock("my-lock"); err == nil {
+		t.Fatalf("extended lock lost its outer hold")
+	}
+}
+
+func TestReentryDoesNotShortenTTL(t *testing.T) {
+	redlock, _ := newTestRedlock(3)
+	owner := NewOwnerID()
+
+	outer, err := redlock.Lock("my-lock", WithOwner(owner), withValidity(time.Minute))
+	if err != nil {
+		t.Fatalf("Lock(outer): %v", err)
+	}
+	if _, err := redlock.Lock("my-lock", WithOwner(owner), withValidity(30*time.Millisecond)); err != nil {
+		t.Fatalf("Lock(inner): %v", err)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if _, err := redlock.Lock("my-lock"); err == nil {
+		t.Fatalf("another client acquired the lock while outer.Remaining() = %v", outer.Remaining())
+	}
+	if info := redlock.Inspect("my-lock"); !info.Quorum || info.Holder != owner {
+		t.Fatalf("Inspect() after the inner TTL = %+v, want the owner on a quorum", info)
+	}
+}
+
+// refuseScript fails every call of script without running it.
+type refuseScript struct {
+	RedisClient
+	script string
+}
+
+func (c refuseScript) Eval(script string, keys []string, args ...interface{}) (interface{}, error) {
+	if script == c.script {
+		return nil, errors.New("refused")
+	}
+	return c.RedisClient.Eval(script, keys, args...)
+}
+
+func TestFailedReentryKeepsOuterHold(t *testing.T) {
+	fakes, servers := NewFakeCluster(3)
+	owner := NewOwnerID()
+	outer, err := NewRedlock(servers).Lock("my-lock", WithOwner(owner), withValidity(time.Minute))
+	if err != nil {
+		t.Fatalf("Lock(outer): %v", err)
+	}
+
+	// Two servers refuse the re-entry, so it applies on one server only and
+	// is rolled back on all three.
+	servers[1] = refuseScript{fakes[1], reentrantLockScript}
+	servers[2] = refuseScript{fakes[2], reentrantLockScript}
+	redlock := NewRedlock(servers, WithRetryStrategy(FixedRetry(1, 0)))
+	var quorumErr *QuorumError
+	if _, err := redlock.Lock("my-lock", WithOwner(owner), withValidity(time.Minute)); !errors.As(err, &quorumErr) {
+		t.Fatalf("Lock(inner) = %v, want a QuorumError", err)
+	}
+
+	if info := redlock.Inspect("my-lock"); info.Agree != 3 || info.Holder != owner {
+		t.Fatalf("Inspect() after the failed re-entry = %+v, want the owner on all 3 servers", info)
+	}
+	if _, err := redlock.Lock("my-lock", WithOwner(NewOwnerID())); err == nil {
+		t.Fatalf("another owner acquired the lock after a failed re-entry")
+	}
+	if err := redlock.Unlock(outer); err != nil {
+		t.Fatalf("Unlock(outer): %v", err)
+	}
+	if info := redlock.Inspect("my-lock"); info.Holder != "" {
+		t.Fatalf("Inspect() after the outer Unlock = %+v, want the lock free", info)
+	}
+}
+
+func TestNewOwnerID(t *testing.T) {
+	first, second := NewOwnerID(), NewOwnerID()
+	if first == second {
+		t.Fatalf("NewOwnerID returned %q twice", first)
+	}
+
+	parts := strings.Split(first, ":")
+	if len(parts) != 3 || len(parts[2]) != 32 {
+		t.Fatalf("NewOwnerID() = %q, want host:pid:128-bit-hex", first)
+	}
+	if host, _ := os.Hostname(); host != "" && parts[0] != host {
+		t.Fatalf("NewOwnerID() = %q, want it to start with host %q", first, host)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// RetryStrategy decides whether Redlock tries to acquire a lock again after
+// a failed attempt and how long it waits before doing so. attempts is the
+// number of attempts made so far.
+type RetryStrategy func(attempts int) (delay time.Duration, retry bool)
+
+// WithRetryStrategy sets the retry strategy used when acquiring locks.
+func WithRetryStrategy(strategy RetryStrategy) func(*Redlock) {
+	return func(r *Redlock) {
+		r.retry = strategy
+	}
+}
+
+// FixedRetry makes up to count attempts, waiting delay between them.
+func FixedRetry(count int, delay time.Duration) RetryStrategy {
+	return func(attempts int) (time.Duration, bool) {
+		return delay, attempts < count
+	}
+}
+
+// LinearBackoff makes up to count attempts, waiting base after the first
+// failed attempt and step longer after each further one.
+func LinearBackoff(count int, base, step time.Duration) RetryStrategy {
+	return func(attempts int) (time.Duration, bool) {
+		return base + time.Duration(attempts-1)*step, attempts < count
+	}
+}
+
+// ExponentialBackoff makes up to count attempts. After the n-th failed
+// attempt it waits a random duration between zero and base*2^(n-1), capped
+// at max ("full jitter"), so that contending clients spread out instead of
+// retrying in lockstep.
+func ExponentialBackoff(count int, base, max time.Duration) RetryStrategy {
+	return func(attempts int) (time.Duration, bool) {
+		if attempts >= count {
+			return 0, false
+		}
+
+		ceiling := base
+		for i := 1; i < attempts && ceiling < max; i++ {
+			ceiling *= 2
+		}
+		if ceiling > max {
+			ceiling = max
+		}
+
+		return jitter(ceiling), true
+	}
+}
+
+var (
+	jitterMu sync.Mutex
+
+	// jitterRand has its own seed so that processes started together do not
+	// draw the same delays.
+	jitterRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// jitter returns a random duration in [0, max].
+func jitter(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+
+	jitterMu.Lock()
+	defer jitterMu.Unlock()
+
+	return time.Duration(jitterRand.Int63n(int64(max) + 1))
+}
+
+// randomIntn returns a random int in [0, n).
+func randomIntn(n int) int {
+	jitterMu.Lock()
+	defer jitterMu.Unlock()
+
+	return jitterRand.Intn(n)
+}
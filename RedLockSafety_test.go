@@ -0,0 +1,343 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HistoryEventKind is the kind of an event in a lock history.
+type HistoryEventKind string
+
+const (
+	// EventAcquire is recorded when a client acquires the lock and enters
+	// its critical section.
+	EventAcquire HistoryEventKind = "acquire"
+
+	// EventPause is recorded when a client is paused inside its critical
+	// section, e.g. by a GC pause.
+	EventPause HistoryEventKind = "pause"
+
+	// EventRelease is recorded when a client leaves its critical section and
+	// releases the lock.
+	EventRelease HistoryEventKind = "release"
+
+	// EventRestart is recorded when a server crashes and restarts.
+	EventRestart HistoryEventKind = "restart"
+
+	// EventClockJump is recorded when a server's clock jumps forward.
+	EventClockJump HistoryEventKind = "clock-jump"
+)
+
+// HistoryEvent is a single event in a lock history.
+type HistoryEvent struct {
+	// At is the time of the event since the start of the run.
+	At time.Duration
+
+	// Kind is the kind of the event.
+	Kind HistoryEventKind
+
+	// Client is the client the event happened to, or -1 for server faults.
+	Client int
+
+	// Server is the server the event happened to, or -1 for client events.
+	Server int
+
+	// Token is the fencing token of the lock for client events.
+	Token uint64
+
+	// Detail is a human-readable description of the event.
+	Detail string
+}
+
+func (e HistoryEvent) String() string {
+	who := fmt.Sprintf("client %d", e.Client)
+	if e.Client < 0 {
+		who = fmt.Sprintf("server %d", e.Server)
+	}
+	return fmt.Sprintf("%10v  %-9s %-10s %s", e.At.Round(time.Microsecond), who, e.Kind, e.Detail)
+}
+
+// Hold is the interval during which a client was inside its critical
+// section.
+type Hold struct {
+	Client int
+	Token  uint64
+	Start  time.Duration
+	End    time.Duration
+}
+
+// Violation describes two clients that were inside their critical sections
+// at the same time.
+type Violation struct {
+	// First and Second are the overlapping holds, ordered by start.
+	First, Second Hold
+
+	// Trace is the part of the history that explains the overlap: the two
+	// clients' events and all server faults from the first acquisition until
+	// the overlap was over.
+	Trace []HistoryEvent
+}
+
+func (v *Violation) String() string {
+	end := v.First.End
+	if v.Second.End < end {
+		end = v.Second.End
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "mutual exclusion violated: client %d (token %d) and client %d (token %d) overlapped for %v\n",
+		v.First.Client, v.First.Token, v.Second.Client, v.Second.Token, (end - v.Second.Start).Round(time.Microsecond))
+	for _, event := range v.Trace {
+		b.WriteString(event.String())
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// SafetyConfig describes a simulated Redlock deployment for CheckSafety.
+type SafetyConfig struct {
+	// Servers is the number of fake Redis servers.
+	Servers int
+
+	// Clients is the number of clients contending for the lock.
+	Clients int
+
+	// Rounds is the number of times every client acquires the lock.
+	Rounds int
+
+	// TTL is the TTL the lock is acquired with.
+	TTL time.Duration
+
+	// Work is the time a client spends inside its critical section.
+	Work time.Duration
+
+	// PauseProbability is the probability that a client is paused for
+	// Pause inside its critical section.
+	PauseProbability float64
+	Pause            time.Duration
+
+	// FaultInterval is the time between server faults. No faults are
+	// injected if it is zero.
+	FaultInterval time.Duration
+
+	// Restarts enables server restarts. A restarted server loses its keys
+	// unless Persist is set.
+	Restarts bool
+	Persist  bool
+
+	// ClockJump is how far a server's clock jumps forward. No clock jumps
+	// are injected if it is zero.
+	ClockJump time.Duration
+
+	// Seed seeds every random choice of the run.
+	Seed int64
+}
+
+// SafetyReport is the outcome of CheckSafety.
+type SafetyReport struct {
+	// History is every event of the run in order.
+	History []HistoryEvent
+
+	// Violation is the first mutual exclusion violation in History, or nil.
+	Violation *Violation
+}
+
+// historyRecorder collects the events of a run from many goroutines.
+type historyRecorder struct {
+	mu     sync.Mutex
+	start  time.Time
+	events []HistoryEvent
+}
+
+func (h *historyRecorder) record(event HistoryEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	event.At = time.Since(h.start)
+	h.events = append(h.events, event)
+}
+
+// CheckSafety drives config.Clients simulated clients through Redlock.Lock
+// and Unlock against fake servers while injecting the configured pauses and
+// faults, and checks the recorded history for mutual exclusion violations.
+// Clients are naive: they do not look at the lock's validity once they have
+// acquired it, just like a process that is paused at the wrong moment.
+func CheckSafety(config SafetyConfig) *SafetyReport {
+	fakes, servers := NewFakeCluster(config.Servers)
+	redlock := NewRedlock(servers,
+		WithRetryStrategy(ExponentialBackoff(1<<30, config.TTL/20, config.TTL/2)),
+		func(r *Redlock) { r.RedisConnectTimeout = config.TTL / 4 },
+	)
+	history := &historyRecorder{start: time.Now()}
+
+	var clients sync.WaitGroup
+	for c := 0; c < config.Clients; c++ {
+		clients.Add(1)
+		go func(c int) {
+			defer clients.Done()
+			runSafetyClient(redlock, history, config, c)
+		}(c)
+	}
+
+	done := make(chan struct{})
+	var injector sync.WaitGroup
+	if config.FaultInterval > 0 {
+		injector.Add(1)
+		go func() {
+			defer injector.Done()
+			injectSafetyFaults(fakes, history, config, done)
+		}()
+	}
+
+	clients.Wait()
+	close(done)
+	injector.Wait()
+
+	return &SafetyReport{
+		History:   history.events,
+		Violation: FindViolation(history.events),
+	}
+}
+
+func runSafetyClient(redlock *Redlock, history *historyRecorder, config SafetyConfig, c int) {
+	random := rand.New(rand.NewSource(config.Seed + int64(c) + 1))
+	withTTL := func(options *LockOptions) { options.Validity = config.TTL }
+
+	for round := 0; round < config.Rounds; round++ {
+		lock, err := redlock.Lock("checked-lock", withTTL)
+		if err != nil {
+			continue
+		}
+		history.record(HistoryEvent{Kind: EventAcquire, Client: c, Server: -1, Token: lock.Token,
+			Detail: fmt.Sprintf("token %d, valid for %v", lock.Token, lock.Validity.Round(time.Microsecond))})
+
+		if random.Float64() < config.PauseProbability {
+			history.record(HistoryEvent{Kind: EventPause, Client: c, Server: -1, Token: lock.Token,
+				Detail: fmt.Sprintf("paused for %v", config.Pause)})
+			time.Sleep(config.Pause)
+		}
+		time.Sleep(config.Work)
+
+		// The release is recorded before unlocking so that the next holder
+		// cannot appear to start before this one has finished.
+		history.record(HistoryEvent{Kind: EventRelease, Client: c, Server: -1, Token: lock.Token,
+			Detail: fmt.Sprintf("leaving with %v of validity left", lock.Remaining().Round(time.Microsecond))})
+		redlock.Unlock(lock)
+	}
+}
+
+func injectSafetyFaults(fakes []*FakeRedis, history *historyRecorder, config SafetyConfig, done <-chan struct{}) {
+	random := rand.New(rand.NewSource(config.Seed))
+
+	var faults []HistoryEventKind
+	if config.Restarts {
+		faults = append(faults, EventRestart)
+	}
+	if config.ClockJump > 0 {
+		faults = append(faults, EventClockJump)
+	}
+	if len(faults) == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(config.FaultInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		server := random.Intn(len(fakes))
+		switch faults[random.Intn(len(faults))] {
+		case EventRestart:
+			fakes[server].Crash(config.Persist)
+			fakes[server].Restart()
+			detail := "restarted, keys lost"
+			if config.Persist {
+				detail = "restarted, keys kept"
+			}
+			history.record(HistoryEvent{Kind: EventRestart, Client: -1, Server: server, Detail: detail})
+		case EventClockJump:
+			fakes[server].JumpClock(config.ClockJump)
+			history.record(HistoryEvent{Kind: EventClockJump, Client: -1, Server: server,
+				Detail: fmt.Sprintf("clock jumped %v forward", config.ClockJump)})
+		}
+	}
+}
+
+// FindViolation returns the earliest pair of overlapping holds in history,
+// or nil if the history respects mutual exclusion.
+func FindViolation(history []HistoryEvent) *Violation {
+	holds := holdsOf(history)
+	sort.Slice(holds, func(i, j int) bool { return holds[i].Start < holds[j].Start })
+
+	// With holds sorted by start, a hold overlaps a later one only if it
+	// overlaps the one right after it.
+	for i := 0; i+1 < len(holds); i++ {
+		first, second := holds[i], holds[i+1]
+		if second.Start < first.End {
+			return &Violation{
+				First:  first,
+				Second: second,
+				Trace:  violationTrace(history, first, second),
+			}
+		}
+	}
+	return nil
+}
+
+// holdsOf pairs every acquire in history with the next release of the same
+// client. A hold that was never released lasts until the end of history.
+func holdsOf(history []HistoryEvent) []Hold {
+	var end time.Duration
+	if len(history) > 0 {
+		end = history[len(history)-1].At
+	}
+
+	open := make(map[int]Hold)
+	var holds []Hold
+	for _, event := range history {
+		switch event.Kind {
+		case EventAcquire:
+			open[event.Client] = Hold{Client: event.Client, Token: event.Token, Start: event.At}
+		case EventRelease:
+			if hold, ok := open[event.Client]; ok {
+				hold.End = event.At
+				holds = append(holds, hold)
+				delete(open, event.Client)
+			}
+		}
+	}
+	for _, hold := range open {
+		hold.End = end
+		holds = append(holds, hold)
+	}
+	return holds
+}
+
+// violationTrace keeps the events of the two clients and all server faults
+// between the first acquisition and the end of the overlap.
+func violationTrace(history []HistoryEvent, first, second Hold) []HistoryEvent {
+	until := first.End
+	if second.End < until {
+		until = second.End
+	}
+
+	var trace []HistoryEvent
+	for _, event := range history {
+		if event.At < first.Start || event.At > until {
+			continue
+		}
+		if event.Client < 0 || event.Client == first.Client || event.Client == second.Client {
+			trace = append(trace, event)
+		}
+	}
+	return trace
+}
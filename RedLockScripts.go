@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"sync"
+)
+
+// ErrNoScript is returned by ScriptLoader.EvalSha when the server does not
+// know the script, e.g. because it restarted and lost its script cache.
+var ErrNoScript = errors.New("NOSCRIPT No matching script")
+
+// ScriptLoader is implemented by RedisClients that can run scripts by their
+// SHA1 digest. Redlock then sends every script once per server instead of
+// with every call.
+type ScriptLoader interface {
+	// ScriptLoad loads script into the server's script cache and returns
+	// its SHA1 digest.
+	ScriptLoad(script string) (string, error)
+
+	// EvalSha runs a cached script. It returns an error wrapping
+	// ErrNoScript if the server does not know the script.
+	EvalSha(sha string, keys []string, args ...interface{}) (interface{}, error)
+}
+
+// scriptCache holds the digests of the scripts a Redlock runs. The lock,
+// unlock and extend scripts are registered up front; the others are added
+// the first time they run.
+type scriptCache struct {
+	mu   sync.RWMutex
+	shas map[string]string
+}
+
+func newScriptCache(scripts ...string) *scriptCache {
+	c := &scriptCache{shas: make(map[string]string)}
+	for _, script := range scripts {
+		c.shas[script] = scriptSHA(script)
+	}
+	return c
+}
+
+// sha returns the digest of script, registering it if necessary.
+func (c *scriptCache) sha(script string) string {
+	c.mu.RLock()
+	sha, ok := c.shas[script]
+	c.mu.RUnlock()
+	if ok {
+		return sha
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	sha = scriptSHA(script)
+	c.shas[script] = sha
+	return sha
+}
+
+// scriptedClient runs the scripts of a RedisClient that is a ScriptLoader
+// with EVALSHA. A server that answers NOSCRIPT gets the script loaded and
+// the call repeated; NOSCRIPT guarantees the script did not run, so the
+// repetition cannot apply it twice.
+type scriptedClient struct {
+	RedisClient
+	loader  ScriptLoader
+	scripts *scriptCache
+}
+
+// Eval runs script by its digest.
+func (c *scriptedClient) Eval(script string, keys []string, args ...interface{}) (interface{}, error) {
+	sha := c.scripts.sha(script)
+	reply, err := c.loader.EvalSha(sha, keys, args...)
+	if !errors.Is(err, ErrNoScript) {
+		return reply, err
+	}
+
+	if _, err := c.loader.ScriptLoad(script); err != nil {
+		return nil, err
+	}
+	return c.loader.EvalSha(sha, keys, args...)
+}
+
+// withScripts wraps the servers that are ScriptLoaders so that they run
+// scripts through scripts. Servers that are already wrapped are rewrapped,
+// so that Redlocks sharing servers keep their own caches.
+func withScripts(servers []RedisClient, scripts *scriptCache) []RedisClient {
+	wrapped := make([]RedisClient, len(servers))
+	for i, server := range servers {
+		server = unwrapScripts(server)
+		if loader, ok := server.(ScriptLoader); ok {
+			wrapped[i] = &scriptedClient{RedisClient: server, loader: loader, scripts: scripts}
+		} else {
+			wrapped[i] = server
+		}
+	}
+	return wrapped
+}
+
+// unwrapScripts returns the RedisClient a scriptedClient wraps, e.g. to
+// reach its optional interfaces.
+func unwrapScripts(server RedisClient) RedisClient {
+	if scripted, ok := server.(*scriptedClient); ok {
+		return scripted.RedisClient
+	}
+	return server
+}
+
+func scriptSHA(script string) string {
+	sum := sha1.Sum([]byte(script))
+	return hex.EncodeToString(sum[:])
+}
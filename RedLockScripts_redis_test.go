@@ -0,0 +1,193 @@
+//go:build redis
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The tests and benchmarks in this file run against the Redis servers listed
+// in REDIS_ADDRS, which unlike FakeRedis run the Lua scripts themselves:
+//
+//	REDIS_ADDRS=localhost:6379,localhost:6380,localhost:6381 \
+//		go test -tags redis -run Redis -bench Redis .
+
+// redisAddrs returns the addresses in REDIS_ADDRS, skipping tb if it is not
+// set.
+func redisAddrs(tb testing.TB) []string {
+	addrs := os.Getenv("REDIS_ADDRS")
+	if addrs == "" {
+		tb.Skip("REDIS_ADDRS is not set")
+	}
+	return strings.Split(addrs, ",")
+}
+
+// scriptStep is a single script call of TestRedisScriptsMatchFake.
+type scriptStep struct {
+	// sleep is how long to wait before the call, e.g. for a heartbeat to
+	// expire.
+	sleep time.Duration
+
+	script string
+	keys   []string
+	args   []interface{}
+
+	// ttls makes integers in the reply compare to the second, since they
+	// are TTLs that run down between the calls to the fake and to Redis.
+	ttls bool
+}
+
+// TestRedisScriptsMatchFake runs every script Redlock sends against Redis and
+// against FakeRedis, and checks that both reply alike.
+func TestRedisScriptsMatchFake(t *testing.T) {
+	client := NewGoRedisClient(redisAddrs(t)[0], time.Second)
+	fake := NewFakeRedis()
+
+	prefix := "redlock-test:" + NewOwnerID() + ":"
+	var used []string
+	k := func(names ...string) []string {
+		keys := make([]string, len(names))
+		for i, name := range names {
+			keys[i] = prefix + name
+			used = append(used, keys[i])
+		}
+		return keys
+	}
+	defer func() {
+		for _, key := range used {
+			client.Del(key)
+		}
+	}()
+
+	steps := []scriptStep{
+		// Plain locks and fencing tokens.
+		{script: lockScript, keys: k("lock", "fence"), args: []interface{}{"v1", 60000}},
+		{script: lockScript, keys: k("lock", "fence"), args: []interface{}{"v2", 60000}},
+		{script: inspectScript, keys: k("lock"), ttls: true},
+		{script: extendScript, keys: k("lock"), args: []interface{}{"v1", 120000}},
+		{script: extendScript, keys: k("lock"), args: []interface{}{"v2", 120000}},
+		{script: inspectScript, keys: k("lock"), ttls: true},
+		{script: raiseFenceScript, keys: k("fence"), args: []interface{}{5}},
+		{script: unlockScript, keys: k("lock"), args: []interface{}{"v2"}},
+		{script: unlockScript, keys: k("lock"), args: []interface{}{"v1"}},
+		{script: lockScript, keys: k("lock", "fence"), args: []interface{}{"v2", 60000}},
+		{script: inspectScript, keys: k("missing"), ttls: true},
+
+		// Reentrant locks: a short re-entry must not shorten the TTL.
+		{script: reentrantLockScript, keys: k("re", "re:holds", "re:fence"), args: []interface{}{"o1", 60000, "h1"}},
+		{script: reentrantLockScript, keys: k("re", "re:holds", "re:fence"), args: []interface{}{"o1", 30, "h2"}},
+		{script: reentrantLockScript, keys: k("re", "re:holds", "re:fence"), args: []interface{}{"o2", 60000, "h3"}},
+		{script: reentrantUnlockScript, keys: k("re", "re:holds"), args: []interface{}{"o1", "h3"}},
+		{script: reentrantUnlockScript, keys: k("re", "re:holds"), args: []interface{}{"o1", "h2"}},
+		{sleep: 50 * time.Millisecond, script: inspectScript, keys: k("re"), ttls: true},
+		{script: reentrantUnlockScript, keys: k("re", "re:holds"), args: []interface{}{"o1", "h1"}},
+		{script: inspectScript, keys: k("re"), ttls: true},
+
+		// Multi-resource locks.
+		{script: multiLockScript, keys: k("a", "b"), args: []interface{}{"v1", 60000}},
+		{script: multiLockScript, keys: k("b", "c"), args: []interface{}{"v2", 60000}},
+		{script: inspectScript, keys: k("c"), ttls: true},
+		{script: multiExtendScript, keys: k("a", "b"), args: []interface{}{"v1", 120000}},
+		{script: multiExtendScript, keys: k("a", "b"), args: []interface{}{"v2", 120000}},
+		{script: multiUnlockScript, keys: k("a", "b", "c"), args: []interface{}{"v1"}},
+		{script: inspectScript, keys: k("a"), ttls: true},
+
+		// Read/write locks: a waiting writer keeps new readers out.
+		{script: rwReadLockScript, keys: k("rw", "rw:readers", "rw:intent"), args: []interface{}{"r1", 60000}},
+		{script: rwWriteLockScript, keys: k("rw", "rw:readers", "rw:intent"), args: []interface{}{"w", 60000}},
+		{script: rwReadLockScript, keys: k("rw", "rw:readers", "rw:intent"), args: []interface{}{"r2", 60000}},
+		{script: rwReadUnlockScript, keys: k("rw:readers"), args: []interface{}{"r1"}},
+		{script: rwWriteLockScript, keys: k("rw", "rw:readers", "rw:intent"), args: []interface{}{"w", 60000}},
+		{script: inspectScript, keys: k("rw"), ttls: true},
+		{script: rwWriteUnlockScript, keys: k("rw", "rw:intent"), args: []interface{}{"w"}},
+		{script: rwReadLockScript, keys: k("rw", "rw:readers", "rw:intent"), args: []interface{}{"r3", 60000}},
+		{script: rwWriteLockScript, keys: k("rw", "rw:readers", "rw:intent"), args: []interface{}{"w", 60000}},
+		{script: rwWriteUnlockScript, keys: k("rw", "rw:intent"), args: []interface{}{"w"}},
+		{script: inspectScript, keys: k("rw:intent"), ttls: true},
+
+		// Fair locks: a waiter whose heartbeat expired is skipped.
+		{script: fairTicketScript, keys: k("fair:seq")},
+		{script: fairTicketScript, keys: k("fair:seq")},
+		{script: lockScript, keys: k("fair", "fair:fence"), args: []interface{}{"holder", 60000}},
+		{script: fairLockScript, keys: k("fair", "fair:queue", "fair:fence", "fair:heartbeats"), args: []interface{}{"dead", 60000, 1, 30}},
+		{script: fairLockScript, keys: k("fair", "fair:queue", "fair:fence", "fair:heartbeats"), args: []interface{}{"alive", 60000, 2, 60000}},
+		{script: unlockScript, keys: k("fair"), args: []interface{}{"holder"}},
+		{sleep: 50 * time.Millisecond, script: fairLockScript, keys: k("fair", "fair:queue", "fair:fence", "fair:heartbeats"), args: []interface{}{"alive", 60000, 2, 60000}},
+		{script: inspectScript, keys: k("fair"), ttls: true},
+		{script: fairLeaveScript, keys: k("fair:queue", "fair:heartbeats"), args: []interface{}{"dead"}},
+	}
+
+	covered := make(map[string]bool)
+	for i, step := range steps {
+		covered[step.script] = true
+		time.Sleep(step.sleep)
+
+		want, err := fake.Eval(step.script, step.keys, step.args...)
+		if err != nil {
+			t.Fatalf("step %d: fake: %v", i, err)
+		}
+		got, err := client.Eval(step.script, step.keys, step.args...)
+		if err != nil {
+			t.Fatalf("step %d: redis: %v", i, err)
+		}
+		if step.ttls {
+			want, got = roundTTLs(want), roundTTLs(got)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("step %d: redis replied %#v, the fake %#v", i, got, want)
+		}
+	}
+
+	for script := range fakeScripts {
+		if !covered[script] {
+			t.Errorf("no step runs script %q", script)
+		}
+	}
+}
+
+// roundTTLs rounds the positive integers in reply to the second.
+func roundTTLs(reply interface{}) interface{} {
+	switch reply := reply.(type) {
+	case int64:
+		if reply > 0 {
+			return fmt.Sprintf("%ds", (reply+500)/1000)
+		}
+		return reply
+	case []interface{}:
+		rounded := make([]interface{}, len(reply))
+		for i, value := range reply {
+			rounded[i] = roundTTLs(value)
+		}
+		return rounded
+	}
+	return reply
+}
+
+func BenchmarkRedisLockUnlockEval(b *testing.B) {
+	benchmarkRedisLockUnlock(b, hideScriptLoader)
+}
+
+func BenchmarkRedisLockUnlockEvalSha(b *testing.B) {
+	benchmarkRedisLockUnlock(b, func(servers []RedisClient) []RedisClient { return servers })
+}
+
+func benchmarkRedisLockUnlock(b *testing.B, wrap func([]RedisClient) []RedisClient) {
+	redlock := NewRedlock(wrap(NewGoRedisClients(redisAddrs(b), time.Second)))
+	name := "redlock-benchmark:" + NewOwnerID()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		lock, err := redlock.Lock(name, withValidity(time.Minute))
+		if err != nil {
+			b.Fatalf("Lock: %v", err)
+		}
+		if err := redlock.Unlock(lock); err != nil {
+			b.Fatalf("Unlock: %v", err)
+		}
+	}
+}
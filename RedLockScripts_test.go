@@ -0,0 +1,106 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// evalOnly hides the ScriptLoader methods of a RedisClient.
+type evalOnly struct {
+	RedisClient
+}
+
+func TestScriptsReloadAfterRestart(t *testing.T) {
+	redlock, fakes := newTestRedlock(3)
+
+	lock, err := redlock.Lock("my-lock")
+	if err != nil {
+		t.Fatalf("Lock: %v", err)
+	}
+	if err := redlock.Unlock(lock); err != nil {
+		t.Fatalf("Unlock: %v", err)
+	}
+
+	// A restarted server has lost its script cache even if it kept its keys.
+	for _, fake := range fakes {
+		fake.Crash(true)
+		fake.Restart()
+	}
+	lock, err = redlock.Lock("my-lock")
+	if err != nil {
+		t.Fatalf("Lock after a restart: %v", err)
+	}
+	if err := redlock.Unlock(lock); err != nil {
+		t.Fatalf("Unlock after a restart: %v", err)
+	}
+}
+
+func TestScriptsSaveBandwidth(t *testing.T) {
+	received := func(servers func([]RedisClient) []RedisClient) int64 {
+		fakes, clients := NewFakeCluster(3)
+		redlock := NewRedlock(servers(clients))
+		for i := 0; i < 100; i++ {
+			lock, err := redlock.Lock("my-lock", withValidity(time.Minute))
+			if err != nil {
+				t.Fatalf("Lock: %v", err)
+			}
+			if err := redlock.Unlock(lock); err != nil {
+				t.Fatalf("Unlock: %v", err)
+			}
+		}
+		var n int64
+		for _, fake := range fakes {
+			n += fake.BytesReceived()
+		}
+		return n
+	}
+
+	withSha := received(func(servers []RedisClient) []RedisClient { return servers })
+	withEval := received(hideScriptLoader)
+	if withSha*4 > withEval*3 {
+		t.Fatalf("EVALSHA sent %d bytes, EVAL %d; want at least a quarter less", withSha, withEval)
+	}
+}
+
+func BenchmarkLockUnlockEval(b *testing.B) {
+	benchmarkLockUnlock(b, hideScriptLoader)
+}
+
+func BenchmarkLockUnlockEvalSha(b *testing.B) {
+	benchmarkLockUnlock(b, func(servers []RedisClient) []RedisClient { return servers })
+}
+
+// benchmarkLockUnlock reports the bytes sent per Lock and Unlock, i.e. the
+// bandwidth EVALSHA saves. FakeRedis does not parse scripts, so its timings
+// say nothing about the parse time saved; the benchmarks built with the
+// redis tag measure that against real servers.
+func benchmarkLockUnlock(b *testing.B, wrap func([]RedisClient) []RedisClient) {
+	fakes, servers := NewFakeCluster(3)
+	redlock := NewRedlock(wrap(servers))
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		lock, err := redlock.Lock("my-lock", withValidity(time.Minute))
+		if err != nil {
+			b.Fatalf("Lock: %v", err)
+		}
+		if err := redlock.Unlock(lock); err != nil {
+			b.Fatalf("Unlock: %v", err)
+		}
+	}
+	b.StopTimer()
+
+	var received int64
+	for _, fake := range fakes {
+		received += fake.BytesReceived()
+	}
+	b.ReportMetric(float64(received)/float64(b.N), "sent-bytes/op")
+}
+
+func hideScriptLoader(servers []RedisClient) []RedisClient {
+	hidden := make([]RedisClient, len(servers))
+	for i, server := range servers {
+		hidden[i] = evalOnly{server}
+	}
+	return hidden
+}
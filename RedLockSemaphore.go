@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrNoPermit is returned when every permit of a Semaphore is taken.
+var ErrNoPermit = errors.New("no permit available")
+
+// ErrSemaphoreSize is returned for a Semaphore without any permits.
+var ErrSemaphoreSize = errors.New("semaphore size must be positive")
+
+// ErrPermitOptions is returned when acquiring a permit with LockOptions that
+// only apply to locks: Owner, Fair and Metadata.
+var ErrPermitOptions = errors.New("permits cannot have an owner, be fair or carry metadata")
+
+// Semaphore is a distributed counting semaphore that hands out up to Size
+// leased permits. Every permit is a slot guarded by its own Redlock, so no
+// more than Size holders can exist even when servers disagree, and a permit
+// whose holder died is reclaimed as soon as its TTL runs out.
+type Semaphore struct {
+	r *Redlock
+
+	// Name is the name of the semaphore.
+	Name string
+
+	// Size is the number of permits.
+	Size int
+}
+
+// NewSemaphore creates a semaphore with size permits that uses the servers,
+// quorum and retry strategy of r. It returns ErrSemaphoreSize if size is not
+// positive.
+func NewSemaphore(r *Redlock, name string, size int) (*Semaphore, error) {
+	if size <= 0 {
+		return nil, fmt.Errorf("%w: %d", ErrSemaphoreSize, size)
+	}
+	return &Semaphore{r: r, Name: name, Size: size}, nil
+}
+
+// PermitHolder describes who holds a permit of a Semaphore.
+type PermitHolder struct {
+	// Slot is the permit's slot.
+	Slot int
+
+	// Holder is the value of the permit's lock on most servers.
+	Holder string
+
+	// Servers is the number of servers that agree on Holder.
+	Servers int
+
+	// Quorum is true if enough servers agree on Holder for it to hold the
+	// permit.
+	Quorum bool
+}
+
+// Acquire acquires a permit.
+func (s *Semaphore) Acquire(opts ...func(*LockOptions)) (*Lock, error) {
+	return s.AcquireContext(context.Background(), opts...)
+}
+
+// AcquireContext acquires a permit, retrying according to the Redlock's
+// RetryStrategy while all permits are taken. It gives up as soon as ctx is
+// done and returns ctx.Err(). The returned lock can be extended with
+// Redlock.Extend like any other lock. Only the Validity option applies to
+// permits; ErrPermitOptions is returned if Owner, Fair or Metadata is set.
+func (s *Semaphore) AcquireContext(ctx context.Context, opts ...func(*LockOptions)) (*Lock, error) {
+	options := &LockOptions{
+		Validity:   time.Second,
+		LockScript: lockScript,
+	}
+
+	for _, opt := range opts {
+		opt(options)
+	}
+	if options.Owner != "" || options.Fair || options.Metadata {
+		return nil, ErrPermitOptions
+	}
+
+	// Size can be changed after NewSemaphore checked it.
+	if s.Size <= 0 {
+		return nil, fmt.Errorf("%w: %d", ErrSemaphoreSize, s.Size)
+	}
+
+	var permit *Lock
+	err := s.r.withRetries(ctx, "acquire permit", s.Name, func() error {
+		// Starting at a random slot spreads contenders over the permits.
+		first := randomIntn(s.Size)
+		var lastErr error
+		for i := 0; i < s.Size; i++ {
+			lock := &Lock{
+				Name:      s.slotKey((first + i) % s.Size),
+				Value:     generateUUID(),
+				Validity:  options.Validity,
+				Timestamp: time.Now().UnixNano() / int64(time.Millisecond),
+			}
+			lastErr = s.r.tryAcquire(ctx, lock, options.Validity, lockRequest{
+				op: "acquire permit",
+				acquire: func(server RedisClient) (int64, error) {
+					return lockAcquired(server, lock, options)
+				},
+				release: func(server RedisClient) (int64, error) {
+					return lockReleased(server, lock)
+				},
+			})
+			if lastErr == nil {
+				permit = lock
+				return nil
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+		}
+		return fmt.Errorf("%w: %v", ErrNoPermit, lastErr)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return permit, nil
+}
+
+// Release gives a permit back.
+func (s *Semaphore) Release(permit *Lock) error {
+	return s.r.Unlock(permit)
+}
+
+// Holders returns the holders of all permits that are set on at least one
+// server, for debugging.
+func (s *Semaphore) Holders() []PermitHolder {
+	var holders []PermitHolder
+	for slot := 0; slot < s.Size; slot++ {
+		values := s.r.values(s.slotKey(slot))
+
+		counts := make(map[string]int)
+		holder := ""
+		for _, value := range values {
+			if value == "" {
+				continue
+			}
+			counts[value]++
+			if counts[value] > counts[holder] {
+				holder = value
+			}
+		}
+		if holder != "" {
+			holders = append(holders, PermitHolder{
+				Slot:    slot,
+				Holder:  holder,
+				Servers: counts[holder],
+				Quorum:  counts[holder] >= s.r.quorum,
+			})
+		}
+	}
+	return holders
+}
+
+func (s *Semaphore) slotKey(slot int) string {
+	return fmt.Sprintf("%s:permit:%d", s.Name, slot)
+}
+
+// values reads key from every server. Servers that fail or do not answer in
+// time are reported with an empty value.
+func (r *Redlock) values(key string) []string {
+	var mu sync.Mutex
+	values := make([]string, len(r.servers))
+
+	var wg sync.WaitGroup
+	for i, server := range r.servers {
+		wg.Add(1)
+		go func(i int, server RedisClient) {
+			defer wg.Done()
+			r.callServer(context.Background(), i, server, func(server RedisClient) (int64, error) {
+				value, err := server.Get(key)
+				if s, ok := value.(string); ok && err == nil {
+					mu.Lock()
+					values[i] = s
+					mu.Unlock()
+				}
+				return 1, err
+			})
+		}(i, server)
+	}
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	return append([]string(nil), values...)
+}
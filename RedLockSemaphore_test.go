@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSemaphoreLimitsHolders(t *testing.T) {
+	redlock, _ := newTestRedlock(3)
+	semaphore := newTestSemaphore(t, redlock, 2)
+
+	first, err := semaphore.Acquire()
+	if err != nil {
+		t.Fatalf("Acquire(first): %v", err)
+	}
+	if _, err := semaphore.Acquire(); err != nil {
+		t.Fatalf("Acquire(second): %v", err)
+	}
+	if _, err := semaphore.Acquire(); !errors.Is(err, ErrNoPermit) {
+		t.Fatalf("Acquire(third) = %v, want ErrNoPermit", err)
+	}
+
+	holders := semaphore.Holders()
+	if len(holders) != 2 {
+		t.Fatalf("Holders() = %+v, want 2 holders", holders)
+	}
+	// The third server may not have answered yet when Acquire returned.
+	for _, holder := range holders {
+		if !holder.Quorum || holder.Servers < 2 {
+			t.Fatalf("holder %+v is not on a quorum of servers", holder)
+		}
+	}
+
+	if err := semaphore.Release(first); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	if _, err := semaphore.Acquire(); err != nil {
+		t.Fatalf("Acquire after a release: %v", err)
+	}
+}
+
+func TestSemaphoreReclaimsExpiredPermits(t *testing.T) {
+	redlock, _ := newTestRedlock(3)
+	semaphore := newTestSemaphore(t, redlock, 1)
+
+	if _, err := semaphore.Acquire(withValidity(30 * time.Millisecond)); err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	time.Sleep(40 * time.Millisecond)
+	if _, err := semaphore.Acquire(); err != nil {
+		t.Fatalf("Acquire after the holder expired: %v", err)
+	}
+}
+
+func TestSemaphoreAcquireContext(t *testing.T) {
+	redlock, _ := newTestRedlock(3, WithRetryStrategy(FixedRetry(100, 10*time.Millisecond)))
+	semaphore := newTestSemaphore(t, redlock, 1)
+
+	holder, err := semaphore.Acquire(withValidity(time.Minute))
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	if _, err := semaphore.AcquireContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("AcquireContext = %v, want context.DeadlineExceeded", err)
+	}
+
+	released := make(chan error, 1)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		released <- semaphore.Release(holder)
+	}()
+	if _, err := semaphore.AcquireContext(context.Background()); err != nil {
+		t.Fatalf("AcquireContext after a release: %v", err)
+	}
+	if err := <-released; err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+}
+
+func TestSemaphoreRejectsNonPositiveSize(t *testing.T) {
+	redlock, _ := newTestRedlock(3)
+
+	for _, size := range []int{0, -1} {
+		if _, err := NewSemaphore(redlock, "vendor-api", size); !errors.Is(err, ErrSemaphoreSize) {
+			t.Fatalf("NewSemaphore(size %d) = %v, want ErrSemaphoreSize", size, err)
+		}
+	}
+
+	semaphore := newTestSemaphore(t, redlock, 1)
+	semaphore.Size = 0
+	if _, err := semaphore.Acquire(); !errors.Is(err, ErrSemaphoreSize) {
+		t.Fatalf("Acquire() with Size 0 = %v, want ErrSemaphoreSize", err)
+	}
+}
+
+func TestSemaphoreRejectsLockOnlyOptions(t *testing.T) {
+	redlock, fakes := newTestRedlock(3)
+	semaphore := newTestSemaphore(t, redlock, 2)
+
+	for name, opt := range map[string]func(*LockOptions){
+		"WithOwner":    WithOwner(NewOwnerID()),
+		"WithFairness": WithFairness(),
+		"WithMetadata": WithMetadata(),
+	} {
+		if _, err := semaphore.Acquire(opt); !errors.Is(err, ErrPermitOptions) {
+			t.Fatalf("Acquire(%s) = %v, want ErrPermitOptions", name, err)
+		}
+	}
+	for i, fake := range fakes {
+		if n := fake.Keys(); n != 0 {
+			t.Fatalf("server %d has %d keys after rejected acquisitions", i, n)
+		}
+	}
+}
+
+func newTestSemaphore(t *testing.T, redlock *Redlock, size int) *Semaphore {
+	t.Helper()
+
+	semaphore, err := NewSemaphore(redlock, "vendor-api", size)
+	if err != nil {
+		t.Fatalf("NewSemaphore: %v", err)
+	}
+	return semaphore
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// WatchdogOptions are the options for keeping a lock alive.
+type WatchdogOptions struct {
+	// TTL is the TTL the lock is extended to on every renewal. It defaults to
+	// the TTL the lock was acquired with, or to the default validity of a
+	// lock if that is unknown, as for a Lock built by the caller.
+	TTL time.Duration
+
+	// Fraction is the fraction of TTL after which the lock is renewed. It
+	// defaults to a third; values outside (0, 1) are replaced by the default.
+	Fraction float64
+}
+
+// defaultWatchdogFraction is the default WatchdogOptions.Fraction.
+const defaultWatchdogFraction = 1.0 / 3
+
+// ErrLockExpired is reported by a Watchdog whose lock's validity ran out
+// before a renewal reached a quorum.
+var ErrLockExpired = errors.New("lock expired before it could be renewed")
+
+// Watchdog renews a lock in the background until it is stopped or a renewal
+// fails to reach a quorum.
+type Watchdog struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// stopped is closed by Stop to end the renewal loop.
+	stopped  chan struct{}
+	stopOnce sync.Once
+
+	// exited is closed once the renewal loop has returned.
+	exited chan struct{}
+
+	mu         sync.Mutex
+	validUntil time.Time
+	err        error
+
+	// expiry cancels the context once validUntil has passed, even while a
+	// renewal is still waiting for the servers.
+	expiry *time.Timer
+}
+
+// KeepAlive starts a watchdog that keeps extending lock until Stop is called.
+// The watchdog's context is cancelled the moment a renewal loses quorum or
+// the lock's validity runs out before a renewal succeeds, at which point the
+// caller is no longer the holder and must stop working.
+func (r *Redlock) KeepAlive(lock *Lock, opts ...func(*WatchdogOptions)) *Watchdog {
+	options := &WatchdogOptions{
+		TTL:      lock.ttl,
+		Fraction: defaultWatchdogFraction,
+	}
+
+	for _, opt := range opts {
+		opt(options)
+	}
+
+	// A non-positive renewal interval would panic in the renewal loop.
+	if options.TTL <= 0 {
+		options.TTL = defaultValidity
+	}
+	if options.Fraction <= 0 || options.Fraction >= 1 {
+		options.Fraction = defaultWatchdogFraction
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &Watchdog{
+		ctx:        ctx,
+		cancel:     cancel,
+		stopped:    make(chan struct{}),
+		exited:     make(chan struct{}),
+		validUntil: lock.ValidUntil,
+	}
+	w.expiry = time.AfterFunc(time.Until(lock.ValidUntil), w.expire)
+
+	go w.run(r, lock, options)
+
+	return w
+}
+
+func (w *Watchdog) run(r *Redlock, lock *Lock, options *WatchdogOptions) {
+	defer close(w.exited)
+	defer w.cancel()
+	defer w.expiry.Stop()
+
+	ticker := time.NewTicker(time.Duration(float64(options.TTL) * options.Fraction))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.stopped:
+			return
+		case <-ticker.C:
+		}
+
+		// A renewal that ends after the lock expired could not save it.
+		w.mu.Lock()
+		ctx, cancel := context.WithDeadline(w.ctx, w.validUntil)
+		w.mu.Unlock()
+		_, validUntil, _, err := r.extend(ctx, lock, options.TTL)
+		cancel()
+
+		w.mu.Lock()
+		if err == nil && w.ctx.Err() == nil {
+			w.validUntil = validUntil
+			w.expiry.Reset(time.Until(validUntil))
+		} else {
+			// The lock may have expired while the renewal was in flight.
+			if w.err == nil && !time.Now().Before(w.validUntil) {
+				w.err = ErrLockExpired
+			} else if w.err == nil {
+				w.err = err
+			}
+			err = w.err
+		}
+		w.mu.Unlock()
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// expire gives up the lock once its validity has run out.
+func (w *Watchdog) expire() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.err == nil {
+		w.err = ErrLockExpired
+	}
+	w.cancel()
+}
+
+// Context returns a context that is cancelled when the lock is lost or the
+// watchdog is stopped.
+func (w *Watchdog) Context() context.Context {
+	return w.ctx
+}
+
+// Done returns a channel that is closed when the lock is lost or the watchdog
+// is stopped.
+func (w *Watchdog) Done() <-chan struct{} {
+	return w.ctx.Done()
+}
+
+// Err returns the error of the renewal that lost the lock, or nil if the
+// lock has not been lost.
+func (w *Watchdog) Err() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.err
+}
+
+// ValidUntil returns the time until which the lock is valid according to the
+// last successful renewal.
+func (w *Watchdog) ValidUntil() time.Time {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.validUntil
+}
+
+// Stop stops renewing the lock and waits for an in-flight renewal to finish.
+// It does not release the lock.
+func (w *Watchdog) Stop() {
+	w.stopOnce.Do(func() { close(w.stopped) })
+	<-w.exited
+}
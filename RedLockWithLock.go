@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrLockLost matches the error WithLock returns when the work was still
+// running when the lock was lost.
+var ErrLockLost = errors.New("work outlived the lock")
+
+// LockLostError is returned by WithLock when the lock was lost while the
+// work was running. Anything the work did after that happened without
+// mutual exclusion.
+type LockLostError struct {
+	// Name is the name of the lock.
+	Name string
+
+	// Cause is why the lock was lost: the renewal error, or
+	// ErrValidityExpired if the lock ran out before it was renewed.
+	Cause error
+
+	// Err is the error the work returned, if any.
+	Err error
+}
+
+func (e *LockLostError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("lock %q lost while working (%v): %v", e.Name, e.Cause, e.Err)
+	}
+	return fmt.Sprintf("lock %q lost while working: %v", e.Name, e.Cause)
+}
+
+// Is reports whether target is ErrLockLost.
+func (e *LockLostError) Is(target error) bool {
+	return target == ErrLockLost
+}
+
+// Unwrap returns the error the work returned.
+func (e *LockLostError) Unwrap() error {
+	return e.Err
+}
+
+// WithSafetyMargin sets how long before the lock's validity ends WithLock
+// cancels the work. See LockOptions.SafetyMargin.
+func WithSafetyMargin(margin time.Duration) func(*LockOptions) {
+	return func(options *LockOptions) {
+		options.SafetyMargin = margin
+	}
+}
+
+// WithLock acquires the named lock, runs fn and releases the lock, even if
+// fn fails or panics. The lock is renewed while fn runs. fn's context is cancelled
+// when ctx is, when a renewal fails, and SafetyMargin before the lock's
+// validity runs out if a renewal is late, so fn should stop touching the
+// protected resource once it is done. If the lock was lost before fn
+// returned, WithLock returns a *LockLostError; otherwise it returns fn's
+// error, or the error releasing the lock.
+func (r *Redlock) WithLock(ctx context.Context, name string, fn func(ctx context.Context) error, opts ...func(*LockOptions)) (err error) {
+	options := &LockOptions{}
+	for _, opt := range opts {
+		opt(options)
+	}
+
+	lock, err := r.LockContext(ctx, name, opts...)
+	if err != nil {
+		return err
+	}
+
+	margin := options.SafetyMargin
+	if margin == 0 {
+		margin = lock.ttl / 10
+	}
+
+	watchdog := r.KeepAlive(lock)
+	work, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var mu sync.Mutex
+	var lost error
+
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			timer := time.NewTimer(time.Until(watchdog.ValidUntil().Add(-margin)))
+			select {
+			case <-stop:
+				timer.Stop()
+				return
+			case <-watchdog.Done():
+				timer.Stop()
+				mu.Lock()
+				lost = watchdog.Err()
+				mu.Unlock()
+				cancel()
+				return
+			case <-timer.C:
+				// The lock may have been renewed while the timer ran.
+				if time.Until(watchdog.ValidUntil().Add(-margin)) > 0 {
+					continue
+				}
+				mu.Lock()
+				lost = ErrValidityExpired
+				mu.Unlock()
+				cancel()
+				return
+			}
+		}
+	}()
+
+	// The lock is released even if fn panics, which then keeps unwinding.
+	var fnErr error
+	defer func() {
+		close(stop)
+		<-stopped
+		watchdog.Stop()
+		unlockErr := r.Unlock(lock)
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		switch {
+		case lost != nil:
+			err = &LockLostError{Name: name, Cause: lost, Err: fnErr}
+		case fnErr != nil:
+			err = fnErr
+		default:
+			err = unlockErr
+		}
+	}()
+
+	fnErr = fn(work)
+	return fnErr
+}
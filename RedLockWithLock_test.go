@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestWithLockReleases(t *testing.T) {
+	redlock, _ := newTestRedlock(3)
+
+	errWork := errors.New("work failed")
+	err := redlock.WithLock(context.Background(), "my-lock", func(ctx context.Context) error {
+		if _, err := redlock.Lock("my-lock"); err == nil {
+			t.Errorf("lock acquired while WithLock holds it")
+		}
+		return errWork
+	})
+	if err != errWork {
+		t.Fatalf("WithLock = %v, want the work's error", err)
+	}
+	if _, err := redlock.Lock("my-lock"); err != nil {
+		t.Fatalf("Lock after WithLock: %v", err)
+	}
+}
+
+func TestWithLockReleasesOnPanic(t *testing.T) {
+	redlock, _ := newTestRedlock(3)
+
+	func() {
+		defer func() {
+			if recovered := recover(); recovered != "boom" {
+				t.Fatalf("recovered %v, want the work's panic", recovered)
+			}
+		}()
+		redlock.WithLock(context.Background(), "my-lock", func(ctx context.Context) error {
+			panic("boom")
+		}, withValidity(time.Minute))
+	}()
+
+	if _, err := redlock.Lock("my-lock"); err != nil {
+		t.Fatalf("Lock after the work panicked: %v", err)
+	}
+}
+
+func TestWithLockRenewsLongWork(t *testing.T) {
+	redlock, _ := newTestRedlock(3)
+
+	err := redlock.WithLock(context.Background(), "my-lock", func(ctx context.Context) error {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(150 * time.Millisecond):
+			return nil
+		}
+	}, withValidity(50*time.Millisecond))
+	if err != nil {
+		t.Fatalf("WithLock over three TTLs: %v", err)
+	}
+}
+
+func TestWithLockCancelsWorkWhenLockIsLost(t *testing.T) {
+	redlock, fakes := newTestRedlock(3)
+
+	err := redlock.WithLock(context.Background(), "my-lock", func(ctx context.Context) error {
+		for _, fake := range fakes[:2] {
+			fake.SetError(errors.New("boom"))
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+			t.Errorf("work was not cancelled when renewals failed")
+			return nil
+		}
+	}, withValidity(60*time.Millisecond))
+
+	var lost *LockLostError
+	if !errors.As(err, &lost) || !errors.Is(err, ErrLockLost) {
+		t.Fatalf("WithLock = %v, want a LockLostError", err)
+	}
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("WithLock = %v, want it to wrap the work's error", err)
+	}
+	var quorumErr *QuorumError
+	if !errors.As(lost.Cause, &quorumErr) {
+		t.Fatalf("lock lost because of %v, want a QuorumError", lost.Cause)
+	}
+}
+
+func TestWithLockReportsLateRenewal(t *testing.T) {
+	redlock, fakes := newTestRedlock(3, func(r *Redlock) { r.RedisConnectTimeout = time.Second })
+
+	err := redlock.WithLock(context.Background(), "my-lock", func(ctx context.Context) error {
+		// Renewals now answer long after the lock would have expired.
+		for _, fake := range fakes {
+			fake.SetLatency(200 * time.Millisecond)
+		}
+		<-ctx.Done()
+		return nil
+	}, withValidity(60*time.Millisecond), WithSafetyMargin(10*time.Millisecond))
+
+	var lost *LockLostError
+	if !errors.As(err, &lost) || lost.Cause != ErrValidityExpired {
+		t.Fatalf("WithLock = %v, want the lock lost to ErrValidityExpired", err)
+	}
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// newTestRedlock creates a Redlock over n fake servers that makes a single
+// attempt per Lock call unless opts say otherwise.
+func newTestRedlock(n int, opts ...func(*Redlock)) (*Redlock, []*FakeRedis) {
+	fakes, servers := NewFakeCluster(n)
+	opts = append([]func(*Redlock){
+		WithRetryStrategy(FixedRetry(1, 0)),
+		func(r *Redlock) { r.RedisConnectTimeout = 100 * time.Millisecond },
+	}, opts...)
+	return NewRedlock(servers, opts...), fakes
+}
+
+func withValidity(validity time.Duration) func(*LockOptions) {
+	return func(options *LockOptions) {
+		options.Validity = validity
+	}
+}
+
+func TestLockQuorum(t *testing.T) {
+	redlock, fakes := newTestRedlock(5)
+
+	fakes[0].Crash(false)
+	fakes[1].Crash(false)
+	lock, err := redlock.Lock("my-lock")
+	if err != nil {
+		t.Fatalf("Lock with 3 of 5 servers up: %v", err)
+	}
+	if err := redlock.Unlock(lock); err != nil {
+		t.Fatalf("Unlock with 3 of 5 servers up: %v", err)
+	}
+
+	fakes[2].Crash(false)
+	_, err = redlock.Lock("my-lock")
+	var quorumErr *QuorumError
+	if !errors.As(err, &quorumErr) {
+		t.Fatalf("Lock with 2 of 5 servers up returned %v, want a QuorumError", err)
+	}
+	for _, result := range quorumErr.Results[:3] {
+		if !errors.Is(result.Err, ErrFakeDown) && !errors.Is(result.Err, ErrNotAwaited) {
+			t.Fatalf("server %d reported %v, want ErrFakeDown", result.Server, result.Err)
+		}
+	}
+}
+
+func TestLockRollsBackMinority(t *testing.T) {
+	redlock, fakes := newTestRedlock(3)
+
+	fakes[1].Set("my-lock", "someone-else", time.Minute)
+	fakes[2].Set("my-lock", "someone-else", time.Minute)
+	// The round ends as soon as a majority refused, so the refusals must come
+	// after fakes[0] took the key for the rollback to have something to undo.
+	fakes[1].SetLatency(10 * time.Millisecond)
+	fakes[2].SetLatency(10 * time.Millisecond)
+	if _, err := redlock.Lock("my-lock"); err == nil {
+		t.Fatalf("Lock succeeded while a majority is held by someone else")
+	}
+
+	if value, _ := fakes[0].Get("my-lock"); value != nil {
+		t.Fatalf("minority key %v was left behind after a failed attempt", value)
+	}
+}
+
+func TestLockValidityAccountsForElapsedTime(t *testing.T) {
+	redlock, fakes := newTestRedlock(3)
+	for _, fake := range fakes {
+		fake.SetLatency(30 * time.Millisecond)
+	}
+
+	lock, err := redlock.Lock("my-lock", withValidity(time.Second))
+	if err != nil {
+		t.Fatalf("Lock: %v", err)
+	}
+	if lock.Validity > 970*time.Millisecond {
+		t.Fatalf("Validity = %v, want the 30ms spent acquiring to be deducted", lock.Validity)
+	}
+	if remaining := lock.Remaining(); remaining <= 0 || remaining > lock.Validity {
+		t.Fatalf("Remaining = %v, want within (0, %v]", remaining, lock.Validity)
+	}
+
+	_, err = redlock.Lock("other-lock", withValidity(20*time.Millisecond))
+	if !errors.Is(err, ErrValidityExpired) {
+		t.Fatalf("Lock with a TTL shorter than the latency returned %v, want ErrValidityExpired", err)
+	}
+}
+
+func TestLockSlowServerDoesNotStall(t *testing.T) {
+	redlock, fakes := newTestRedlock(3, func(r *Redlock) {
+		r.RedisConnectTimeout = time.Second
+	})
+	fakes[2].SetLatency(500 * time.Millisecond)
+
+	start := time.Now()
+	lock, err := redlock.Lock("my-lock")
+	if err != nil {
+		t.Fatalf("Lock: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 250*time.Millisecond {
+		t.Fatalf("Lock took %v, want it to return once 2 fast servers agreed", elapsed)
+	}
+	if !errors.Is(lock.Votes[2].Err, ErrNotAwaited) {
+		t.Fatalf("slow server reported %v, want ErrNotAwaited", lock.Votes[2].Err)
+	}
+}
+
+func TestLockPartitionTimesOut(t *testing.T) {
+	redlock, fakes := newTestRedlock(3)
+	fakes[1].Partition()
+	fakes[2].Partition()
+	defer fakes[1].Heal()
+	defer fakes[2].Heal()
+
+	_, err := redlock.Lock("my-lock")
+	var quorumErr *QuorumError
+	if !errors.As(err, &quorumErr) {
+		t.Fatalf("Lock across a partition returned %v, want a QuorumError", err)
+	}
+	if !errors.Is(quorumErr.Results[1].Err, ErrServerTimeout) {
+		t.Fatalf("partitioned server reported %v, want ErrServerTimeout", quorumErr.Results[1].Err)
+	}
+}
+
+func TestLockContextCancelled(t *testing.T) {
+	redlock, fakes := newTestRedlock(3, WithRetryStrategy(FixedRetry(100, 10*time.Millisecond)))
+	for _, fake := range fakes {
+		fake.Set("my-lock", "someone-else", time.Minute)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := redlock.LockContext(ctx, "my-lock"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("LockContext returned %v, want context.DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("LockContext took %v after its context expired", elapsed)
+	}
+}
+
+func TestFencingTokensIncreaseAcrossFailover(t *testing.T) {
+	redlock, fakes := newTestRedlock(3)
+
+	first, err := redlock.Lock("my-lock")
+	if err != nil {
+		t.Fatalf("Lock: %v", err)
+	}
+	if err := redlock.Unlock(first); err != nil {
+		t.Fatalf("Unlock: %v", err)
+	}
+
+	// The restarted server has lost its counter, but every quorum overlaps
+	// one that remembers the last token.
+	fakes[0].Crash(false)
+	fakes[0].Restart()
+	fakes[1].Crash(false)
+
+	second, err := redlock.Lock("my-lock")
+	if err != nil {
+		t.Fatalf("Lock after failover: %v", err)
+	}
+	if second.Token <= first.Token {
+		t.Fatalf("token after failover = %d, want more than %d", second.Token, first.Token)
+	}
+}
+
+func TestCrashWithKeyLossBreaksMutualExclusion(t *testing.T) {
+	for _, keepData := range []bool{false, true} {
+		redlock, fakes := newTestRedlock(3)
+
+		fakes[2].Partition()
+		alice, err := redlock.Lock("my-lock", withValidity(time.Minute))
+		if err != nil {
+			t.Fatalf("Lock(alice): %v", err)
+		}
+		// Let the requests that were not waited for reach the partition
+		// before it heals.
+		time.Sleep(20 * time.Millisecond)
+		fakes[2].Heal()
+
+		fakes[1].Crash(keepData)
+		fakes[1].Restart()
+
+		bob, err := redlock.Lock("my-lock", withValidity(time.Minute))
+		if keepData && err == nil {
+			t.Fatalf("bob acquired a lock held by alice although no keys were lost")
+		}
+		// The lost keys include the fencing counter, so the tokens cannot
+		// tell the two holders apart either.
+		if !keepData && (err != nil || bob.Token > alice.Token) {
+			t.Fatalf("expected the lost key to let bob in with a reused token, got %v", err)
+		}
+	}
+}
+
+func TestClockJumpExpiresLock(t *testing.T) {
+	redlock, fakes := newTestRedlock(3)
+
+	if _, err := redlock.Lock("my-lock", withValidity(time.Minute)); err != nil {
+		t.Fatalf("Lock: %v", err)
+	}
+	if _, err := redlock.Lock("my-lock"); err == nil {
+		t.Fatalf("second Lock succeeded while the first is held")
+	}
+
+	fakes[0].JumpClock(time.Minute)
+	fakes[1].SetClockRate(1000)
+	time.Sleep(60 * time.Millisecond)
+
+	if _, err := redlock.Lock("my-lock"); err != nil {
+		t.Fatalf("Lock after the servers' clocks ran ahead: %v", err)
+	}
+}
+
+func TestExtendAndWatchdog(t *testing.T) {
+	redlock, fakes := newTestRedlock(3)
+
+	lock, err := redlock.Lock("my-lock", withValidity(90*time.Millisecond))
+	if err != nil {
+		t.Fatalf("Lock: %v", err)
+	}
+	if err := redlock.Extend(lock, time.Second); err != nil {
+		t.Fatalf("Extend: %v", err)
+	}
+	if lock.Remaining() < 900*time.Millisecond {
+		t.Fatalf("Remaining after Extend = %v, want about a second", lock.Remaining())
+	}
+
+	watchdog := redlock.KeepAlive(lock, func(options *WatchdogOptions) {
+		options.TTL = 90 * time.Millisecond
+	})
+	defer watchdog.Stop()
+
+	time.Sleep(200 * time.Millisecond)
+	select {
+	case <-watchdog.Done():
+		t.Fatalf("watchdog gave up while all servers are healthy: %v", watchdog.Err())
+	default:
+	}
+
+	fakes[0].Crash(false)
+	fakes[1].Crash(false)
+	select {
+	case <-watchdog.Done():
+	case <-time.After(time.Second):
+		t.Fatalf("watchdog did not notice that the lock lost its quorum")
+	}
+	var quorumErr *QuorumError
+	if !errors.As(watchdog.Err(), &quorumErr) {
+		t.Fatalf("watchdog.Err() = %v, want a QuorumError", watchdog.Err())
+	}
+}
+
+func TestWatchdogGivesUpAtValidity(t *testing.T) {
+	// A server call may take longer than the lock is valid.
+	redlock, fakes := newTestRedlock(3, func(r *Redlock) {
+		r.RedisConnectTimeout = time.Second
+	})
+
+	start := time.Now()
+	lock, err := redlock.Lock("my-lock", withValidity(300*time.Millisecond))
+	if err != nil {
+		t.Fatalf("Lock: %v", err)
+	}
+	watchdog := redlock.KeepAlive(lock)
+	defer watchdog.Stop()
+
+	for _, fake := range fakes {
+		fake.Partition()
+		defer fake.Heal()
+	}
+	select {
+	case <-watchdog.Done():
+	case <-time.After(time.Until(start.Add(300 * time.Millisecond))):
+		t.Fatalf("watchdog still holds the lock after its TTL")
+	}
+	if !errors.Is(watchdog.Err(), ErrLockExpired) {
+		t.Fatalf("watchdog.Err() = %v, want ErrLockExpired", watchdog.Err())
+	}
+}
+
+func TestWatchdogReplacesInvalidOptions(t *testing.T) {
+	redlock, _ := newTestRedlock(3)
+
+	lock, err := redlock.Lock("my-lock", withValidity(time.Minute))
+	if err != nil {
+		t.Fatalf("Lock: %v", err)
+	}
+
+	// A Lock built by the caller has no TTL, and a non-positive fraction
+	// would make the renewal interval non-positive as well.
+	tests := []struct {
+		name string
+		lock *Lock
+		opts []func(*WatchdogOptions)
+	}{
+		{"lock without TTL", &Lock{Name: lock.Name, Value: lock.Value, ValidUntil: lock.ValidUntil}, nil},
+		{"zero fraction", lock, []func(*WatchdogOptions){func(options *WatchdogOptions) {
+			options.TTL = 90 * time.Millisecond
+			options.Fraction = 0
+		}}},
+		{"negative fraction", lock, []func(*WatchdogOptions){func(options *WatchdogOptions) {
+			options.TTL = 90 * time.Millisecond
+			options.Fraction = -1
+		}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			watchdog := redlock.KeepAlive(test.lock, test.opts...)
+			defer watchdog.Stop()
+
+			time.Sleep(50 * time.Millisecond)
+			select {
+			case <-watchdog.Done():
+				t.Fatalf("watchdog gave up: %v", watchdog.Err())
+			default:
+			}
+		})
+	}
+}
+
+func TestFakeRedisClock(t *testing.T) {
+	fake := NewFakeRedis()
+	fake.Set("key", "value", time.Minute)
+
+	if value, err := fake.Get("key"); err != nil || value != "value" {
+		t.Fatalf("Get = %v, %v", value, err)
+	}
+
+	fake.JumpClock(time.Minute)
+	if value, _ := fake.Get("key"); value != nil {
+		t.Fatalf("key survived a clock jump past its TTL")
+	}
+
+	fake.Set("key", "value", time.Minute)
+	fake.Crash(true)
+	if _, err := fake.Get("key"); !errors.Is(err, ErrFakeDown) {
+		t.Fatalf("Get on a crashed server returned %v", err)
+	}
+	fake.Restart()
+	if value, _ := fake.Get("key"); value != "value" {
+		t.Fatalf("persisted key was lost on restart")
+	}
+}
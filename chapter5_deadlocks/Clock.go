@@ -0,0 +1,154 @@
+package chapter5_deadlocks
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock tells the lease types what time it is, so that tests and demos can
+// expire leases without sleeping.
+type Clock interface {
+	Now() time.Time
+
+	// NewTimer creates a Timer that fires once d has passed.
+	NewTimer(d time.Duration) Timer
+
+	// AfterFunc creates a Timer that calls f in its own goroutine once d has
+	// passed. The channel of the Timer is nil.
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a single-shot timer created by a Clock.
+type Timer interface {
+	// C returns the channel that the time is sent on when the timer fires.
+	C() <-chan time.Time
+
+	// Stop prevents the timer from firing. It returns false if the timer
+	// already fired or was stopped.
+	Stop() bool
+}
+
+// RealClock is the Clock that leases use unless they are given another one.
+var RealClock Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+	return realTimer{time.AfterFunc(d, f)}
+}
+
+type realTimer struct {
+	*time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
+
+// ManualClock is a Clock that only moves when it is told to.
+type ManualClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*manualTimer
+}
+
+// NewManualClock creates a ManualClock that starts at now.
+func NewManualClock(now time.Time) *ManualClock {
+	return &ManualClock{now: now}
+}
+
+// Now returns the current time of the clock.
+func (c *ManualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+// NewTimer creates a Timer that fires when Advance moves the clock d past
+// its current time. A timer for d <= 0 fires right away.
+func (c *ManualClock) NewTimer(d time.Duration) Timer {
+	return c.addTimer(d, &manualTimer{c: make(chan time.Time, 1)})
+}
+
+// AfterFunc creates a Timer that calls f when Advance moves the clock d past
+// its current time. A timer for d <= 0 calls f right away.
+func (c *ManualClock) AfterFunc(d time.Duration, f func()) Timer {
+	return c.addTimer(d, &manualTimer{f: f})
+}
+
+func (c *ManualClock) addTimer(d time.Duration, t *manualTimer) Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t.clock, t.when = c, c.now.Add(d)
+	if d <= 0 {
+		t.fire(c.now)
+		return t
+	}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// Advance moves the clock forward by d and fires the timers that are due.
+func (c *ManualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+
+	pending := c.timers[:0]
+	for _, t := range c.timers {
+		if t.when.After(c.now) {
+			pending = append(pending, t)
+			continue
+		}
+		t.fire(c.now)
+	}
+	for i := len(pending); i < len(c.timers); i++ {
+		c.timers[i] = nil
+	}
+	c.timers = pending
+}
+
+type manualTimer struct {
+	clock *ManualClock
+	when  time.Time
+
+	// Either c or f is set.
+	c chan time.Time
+	f func()
+}
+
+func (t *manualTimer) fire(now time.Time) {
+	if t.f != nil {
+		go t.f()
+		return
+	}
+	t.c <- now
+}
+
+func (t *manualTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *manualTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+
+	for i, pending := range t.clock.timers {
+		if pending == t {
+			t.clock.timers = append(t.clock.timers[:i], t.clock.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,93 @@
+package chapter5_deadlocks
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrStaleToken is returned by FencedStore when a write carries an older
+// fencing token than one the store has already seen for the key.
+var ErrStaleToken = errors.New("stale fencing token")
+
+// KV is a key-value store that a FencedStore guards.
+type KV interface {
+	Get(key string) (string, bool)
+	Put(key, value string)
+}
+
+// MemoryKV is an in-memory KV.
+type MemoryKV struct {
+	mu   sync.RWMutex
+	data map[string]string
+}
+
+// NewMemoryKV creates an empty in-memory KV.
+func NewMemoryKV() *MemoryKV {
+	return &MemoryKV{data: make(map[string]string)}
+}
+
+// Get returns the value stored under key and whether there is one.
+func (kv *MemoryKV) Get(key string) (string, bool) {
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+
+	value, ok := kv.data[key]
+	return value, ok
+}
+
+// Put stores value under key.
+func (kv *MemoryKV) Put(key, value string) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	kv.data[key] = value
+}
+
+// FencedStore guards a KV with fencing tokens. It records the highest token
+// that has written each key and rejects writes carrying an older one, so a
+// client whose lease expired while it was paused cannot overwrite the work of
+// the holder that came after it.
+type FencedStore struct {
+	kv KV
+
+	mu      sync.Mutex
+	highest map[string]uint64
+}
+
+// NewFencedStore creates a FencedStore that guards kv.
+func NewFencedStore(kv KV) *FencedStore {
+	return &FencedStore{kv: kv, highest: make(map[string]uint64)}
+}
+
+// Put stores value under key on behalf of the lease holder with token. It
+// returns an error wrapping ErrStaleToken if a write with a newer token has
+// already been accepted for key. Writes with the same token are accepted, so a
+// holder can write a key more than once.
+func (s *FencedStore) Put(key, value string, token uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if highest := s.highest[key]; token < highest {
+		return fmt.Errorf("%w: token %d for %q is older than %d", ErrStaleToken, token, key, highest)
+	}
+
+	s.highest[key] = token
+	s.kv.Put(key, value)
+	return nil
+}
+
+// Get returns the value stored under key and whether there is one. Reads are
+// not fenced.
+func (s *FencedStore) Get(key string) (string, bool) {
+	return s.kv.Get(key)
+}
+
+// HighestToken returns the highest token that has written key, or zero if
+// none has.
+func (s *FencedStore) HighestToken(key string) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.highest[key]
+}
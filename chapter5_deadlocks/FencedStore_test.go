@@ -0,0 +1,138 @@
+package chapter5_deadlocks
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLeaseTokensIncrease(t *testing.T) {
+	clock := NewManualClock(time.Unix(0, 0))
+	lease := NewLeaseWithClock(testTTL, clock)
+
+	var last uint64
+	for i := 0; i < 3; i++ {
+		token, err := lease.Acquire("Alice")
+		if err != nil {
+			t.Fatalf("Acquire(): %v", err)
+		}
+		if token <= last {
+			t.Fatalf("acquisition %d got token %d, want more than %d", i, token, last)
+		}
+		last = token
+		if err := lease.Release("Alice", token); err != nil {
+			t.Fatalf("Release(): %v", err)
+		}
+	}
+
+	// Expiry does not reset the counter either.
+	stale, err := lease.Acquire("Alice")
+	if err != nil {
+		t.Fatalf("Acquire(): %v", err)
+	}
+	clock.Advance(testTTL)
+	token, err := lease.Acquire("Bob")
+	if err != nil {
+		t.Fatalf("Acquire() after expiry: %v", err)
+	}
+	if token <= stale {
+		t.Fatalf("acquisition after expiry got token %d, want more than %d", token, stale)
+	}
+}
+
+func TestThreadSafeLeaseTokensIncrease(t *testing.T) {
+	lease := NewThreadSafeLease(time.Minute)
+
+	first, err := lease.Acquire("Alice")
+	if err != nil {
+		t.Fatalf("Acquire(): %v", err)
+	}
+	if got := lease.Token(); got != first {
+		t.Fatalf("Token() = %d, want %d", got, first)
+	}
+	if err := lease.Release("Alice", first); err != nil {
+		t.Fatalf("Release(): %v", err)
+	}
+	if got := lease.Token(); got != 0 {
+		t.Fatalf("Token() of a free lease = %d, want 0", got)
+	}
+
+	second, err := lease.Acquire("Bob")
+	if err != nil {
+		t.Fatalf("Acquire(): %v", err)
+	}
+	if second <= first {
+		t.Fatalf("second acquisition got token %d, want more than %d", second, first)
+	}
+}
+
+func TestFencedStoreRejectsOlderTokens(t *testing.T) {
+	store := NewFencedStore(NewMemoryKV())
+
+	if err := store.Put("file", "v2", 2); err != nil {
+		t.Fatalf("Put() with token 2: %v", err)
+	}
+	if err := store.Put("file", "v2'", 2); err != nil {
+		t.Fatalf("Put() with the same token again: %v", err)
+	}
+	if err := store.Put("file", "v1", 1); !errors.Is(err, ErrStaleToken) {
+		t.Fatalf("Put() with token 1 = %v, want ErrStaleToken", err)
+	}
+	if err := store.Put("other", "v1", 1); err != nil {
+		t.Fatalf("Put() of another key with token 1: %v", err)
+	}
+
+	if value, _ := store.Get("file"); value != "v2'" {
+		t.Fatalf("Get() = %q, want %q", value, "v2'")
+	}
+	if highest := store.HighestToken("file"); highest != 2 {
+		t.Fatalf("HighestToken() = %d, want 2", highest)
+	}
+}
+
+// TestPausedClientIsFenced reproduces the classic failure of leases without
+// fencing: a client pauses (say, for a long GC) while holding the lease, the
+// lease expires and another client takes it, and then the first client wakes
+// up and writes, believing it still holds the lease.
+func TestPausedClientIsFenced(t *testing.T) {
+	clock := NewManualClock(time.Unix(0, 0))
+	lease := NewThreadSafeLeaseWithClock(testTTL, clock)
+	store := NewFencedStore(NewMemoryKV())
+
+	aliceToken, err := lease.Acquire("Alice")
+	if err != nil {
+		t.Fatalf("Alice Acquire(): %v", err)
+	}
+
+	paused := make(chan struct{})
+	resume := make(chan struct{})
+	written := make(chan error, 1)
+	go func() {
+		// Alice checked her lease, then stops the world before writing.
+		close(paused)
+		<-resume
+		written <- store.Put("file", "written by Alice", aliceToken)
+	}()
+	<-paused
+
+	// Alice's lease expires while she is paused.
+	clock.Advance(testTTL)
+	bobToken, err := lease.Acquire("Bob")
+	if err != nil {
+		t.Fatalf("Bob Acquire() after Alice's lease expired: %v", err)
+	}
+	if err := store.Put("file", "written by Bob", bobToken); err != nil {
+		t.Fatalf("Bob Put(): %v", err)
+	}
+
+	close(resume)
+	if err := <-written; !errors.Is(err, ErrStaleToken) {
+		t.Fatalf("Alice's write after her lease expired = %v, want ErrStaleToken", err)
+	}
+	if value, _ := store.Get("file"); value != "written by Bob" {
+		t.Fatalf("Get() = %q, want Bob's write to survive", value)
+	}
+	if err := lease.Renew("Alice", aliceToken, time.Minute); err == nil {
+		t.Fatalf("Alice renewed a lease that Bob holds")
+	}
+}
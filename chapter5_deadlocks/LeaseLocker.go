@@ -0,0 +1,100 @@
+package chapter5_deadlocks
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/saidatta/DistributedAlgorithms/locker"
+)
+
+// leasePollInterval is how often a LeaseLocker tries a held lease again.
+const leasePollInterval = 5 * time.Millisecond
+
+// lease is what Lease and ThreadSafeLease have in common.
+type lease interface {
+	Acquire(holder string) (uint64, error)
+	Renew(holder string, token uint64, ttl time.Duration) error
+	Release(holder string, token uint64) error
+	remaining(holder string, token uint64) time.Duration
+}
+
+// LeaseLocker is a locker.Locker that acquires a Lease or ThreadSafeLease as
+// a single holder.
+type LeaseLocker struct {
+	lease lease
+
+	// Holder is the name the lease is acquired under.
+	Holder string
+}
+
+// NewLeaseLocker creates a locker.Locker that acquires lease as holder.
+func NewLeaseLocker(lease *Lease, holder string) *LeaseLocker {
+	return &LeaseLocker{lease: lease, Holder: holder}
+}
+
+// NewThreadSafeLeaseLocker creates a locker.Locker that acquires lease as
+// holder.
+func NewThreadSafeLeaseLocker(lease *ThreadSafeLease, holder string) *LeaseLocker {
+	return &LeaseLocker{lease: lease, Holder: holder}
+}
+
+// Acquire acquires the lease. It waits its turn if the lease supports
+// AcquireWait, and otherwise tries again every leasePollInterval while the
+// lease is held by someone else.
+func (l *LeaseLocker) Acquire(ctx context.Context) (locker.Lock, error) {
+	if waiter, ok := l.lease.(interface {
+		AcquireWait(ctx context.Context, holder string) (uint64, error)
+	}); ok {
+		token, err := waiter.AcquireWait(ctx, l.Holder)
+		if err != nil {
+			return nil, err
+		}
+		return &leaseLock{lease: l.lease, holder: l.Holder, token: token}, nil
+	}
+
+	ticker := time.NewTicker(leasePollInterval)
+	defer ticker.Stop()
+
+	for {
+		token, err := l.lease.Acquire(l.Holder)
+		if err == nil {
+			return &leaseLock{lease: l.lease, holder: l.Holder, token: token}, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// leaseLock is a locker.Lock on a held lease.
+type leaseLock struct {
+	lease  lease
+	holder string
+	token  uint64
+}
+
+func (l *leaseLock) Token() uint64 {
+	return l.token
+}
+
+func (l *leaseLock) Remaining() time.Duration {
+	return l.lease.remaining(l.holder, l.token)
+}
+
+func (l *leaseLock) Renew(ctx context.Context, ttl time.Duration) error {
+	if err := l.lease.Renew(l.holder, l.token, ttl); err != nil {
+		return fmt.Errorf("%w: %v", locker.ErrNotHeld, err)
+	}
+	return nil
+}
+
+func (l *leaseLock) Release(ctx context.Context) error {
+	if err := l.lease.Release(l.holder, l.token); err != nil {
+		return fmt.Errorf("%w: %v", locker.ErrNotHeld, err)
+	}
+	return nil
+}
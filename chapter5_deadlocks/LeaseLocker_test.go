@@ -0,0 +1,32 @@
+package chapter5_deadlocks
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/saidatta/DistributedAlgorithms/locker"
+	"github.com/saidatta/DistributedAlgorithms/locker/lockertest"
+)
+
+func TestLeaseLockerConformance(t *testing.T) {
+	lockertest.Run(t, func(t *testing.T, ttl time.Duration) func() locker.Locker {
+		lease := NewLease(ttl)
+		clients := 0
+		return func() locker.Locker {
+			clients++
+			return NewLeaseLocker(lease, fmt.Sprintf("client-%d", clients))
+		}
+	})
+}
+
+func TestThreadSafeLeaseLockerConformance(t *testing.T) {
+	lockertest.Run(t, func(t *testing.T, ttl time.Duration) func() locker.Locker {
+		lease := NewThreadSafeLease(ttl)
+		clients := 0
+		return func() locker.Locker {
+			clients++
+			return NewThreadSafeLeaseLocker(lease, fmt.Sprintf("client-%d", clients))
+		}
+	})
+}
@@ -0,0 +1,277 @@
+package chapter5_deadlocks
+
+import (
+	"container/heap"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// sweepBatch is how many leases the sweeper expires before it lets other
+// callers of the table in.
+const sweepBatch = 1024
+
+// LeaseTable holds leases on many resources, keyed by resource name. A single
+// sweeper goroutine expires leases in order of their expiration, so the table
+// only keeps entries for resources that are currently leased.
+type LeaseTable struct {
+	// ttl is the time-to-live for every lease acquired from the table.
+	ttl time.Duration
+
+	clock Clock
+
+	mu sync.Mutex
+
+	// leases holds the lease on every leased resource.
+	leases map[string]*tableLease
+
+	// expirations orders the leases by expiration for the sweeper.
+	expirations leaseHeap
+
+	// lastToken is the token assigned by the latest acquisition of any resource.
+	// Entries are deleted when they expire, so the counter is shared to keep the
+	// tokens of every resource increasing.
+	lastToken uint64
+
+	// armed is when the sweeper's timer fires, or zero if it is not set.
+	armed time.Time
+
+	// wake tells the sweeper that a lease expires before its timer fires.
+	wake chan struct{}
+
+	closeOnce sync.Once
+	done      chan struct{}
+	stopped   chan struct{}
+}
+
+// LeaseInfo describes a lease held in a LeaseTable.
+type LeaseInfo struct {
+	Name       string
+	Holder     string
+	Token      uint64
+	Expiration time.Time
+}
+
+// tableLease is the lease on one resource of a LeaseTable.
+type tableLease struct {
+	LeaseInfo
+
+	// index is the position of the lease in the table's expirations.
+	index int
+}
+
+// NewLeaseTable creates a LeaseTable whose leases are valid for ttl after
+// every acquisition, and starts its sweeper. Close stops the sweeper.
+func NewLeaseTable(ttl time.Duration) *LeaseTable {
+	return NewLeaseTableWithClock(ttl, RealClock)
+}
+
+// NewLeaseTableWithClock creates a LeaseTable whose leases are valid for ttl
+// after every acquisition, as told by clock, and starts its sweeper.
+func NewLeaseTableWithClock(ttl time.Duration, clock Clock) *LeaseTable {
+	t := &LeaseTable{
+		ttl:     ttl,
+		clock:   clock,
+		leases:  make(map[string]*tableLease),
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go t.sweep()
+	return t
+}
+
+// Acquire acquires the lease on the resource called name for holder and returns its fencing token.
+// If the lease is already held by another holder, this function will return an error.
+func (t *LeaseTable) Acquire(name, holder string) (uint64, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.clock.Now()
+	lease, ok := t.leases[name]
+	if ok && now.Before(lease.Expiration) {
+		return 0, fmt.Errorf("lease on %s already held by %s", name, lease.Holder)
+	}
+
+	// An expired lease that the sweeper has not removed yet is reused.
+	t.lastToken++
+	if !ok {
+		lease = &tableLease{LeaseInfo: LeaseInfo{Name: name}}
+		t.leases[name] = lease
+		heap.Push(&t.expirations, lease)
+	}
+	lease.Holder = holder
+	lease.Token = t.lastToken
+	t.setExpiration(lease, now.Add(t.ttl))
+
+	return lease.Token, nil
+}
+
+// Renew renews the lease on the resource called name and extends the expiration time by the specified time-to-live (TTL).
+// If the token is invalid or the lease has already expired, this function will return an error.
+func (t *LeaseTable) Renew(name, holder string, token uint64, ttl time.Duration) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.clock.Now()
+	lease, err := t.held(name, holder, token, now)
+	if err != nil {
+		return err
+	}
+
+	t.setExpiration(lease, now.Add(ttl))
+	return nil
+}
+
+// Release releases the lease on the resource called name and allows another holder to acquire it.
+// If the token is invalid or the lease has already expired, this function will return an error.
+func (t *LeaseTable) Release(name, holder string, token uint64) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	lease, err := t.held(name, holder, token, t.clock.Now())
+	if err != nil {
+		return err
+	}
+
+	t.remove(lease)
+	return nil
+}
+
+// List returns the leases that are currently held, sorted by resource name.
+func (t *LeaseTable) List() []LeaseInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.clock.Now()
+	infos := make([]LeaseInfo, 0, len(t.leases))
+	for _, lease := range t.leases {
+		if now.Before(lease.Expiration) {
+			infos = append(infos, lease.LeaseInfo)
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name < infos[j].Name
+	})
+	return infos
+}
+
+// Len returns the number of entries in the table, including leases that
+// have expired but were not swept yet.
+func (t *LeaseTable) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return len(t.leases)
+}
+
+// Close stops the sweeper. The table must not be used afterwards.
+func (t *LeaseTable) Close() {
+	t.closeOnce.Do(func() {
+		close(t.done)
+	})
+	<-t.stopped
+}
+
+// held returns the lease on name if holder holds it with token at now.
+func (t *LeaseTable) held(name, holder string, token uint64, now time.Time) (*tableLease, error) {
+	lease, ok := t.leases[name]
+	if !ok || lease.Holder != holder || lease.Token != token || !now.Before(lease.Expiration) {
+		return nil, fmt.Errorf("invalid token or lease has expired")
+	}
+	return lease, nil
+}
+
+// setExpiration moves the expiration of lease, waking the sweeper if it now
+// has to fire earlier.
+func (t *LeaseTable) setExpiration(lease *tableLease, expiration time.Time) {
+	lease.Expiration = expiration
+	heap.Fix(&t.expirations, lease.index)
+
+	if t.armed.IsZero() || expiration.Before(t.armed) {
+		select {
+		case t.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (t *LeaseTable) remove(lease *tableLease) {
+	heap.Remove(&t.expirations, lease.index)
+	delete(t.leases, lease.Name)
+}
+
+// sweep removes leases as they expire until the table is closed.
+func (t *LeaseTable) sweep() {
+	defer close(t.stopped)
+
+	for {
+		t.mu.Lock()
+		now := t.clock.Now()
+		swept := 0
+		for ; swept < sweepBatch && len(t.expirations) > 0 && !now.Before(t.expirations[0].Expiration); swept++ {
+			t.remove(t.expirations[0])
+		}
+		if swept == sweepBatch {
+			t.mu.Unlock()
+			continue
+		}
+
+		var timer Timer
+		var fired <-chan time.Time
+		t.armed = time.Time{}
+		if len(t.expirations) > 0 {
+			t.armed = t.expirations[0].Expiration
+			timer = t.clock.NewTimer(t.armed.Sub(now))
+			fired = timer.C()
+		}
+		t.mu.Unlock()
+
+		select {
+		case <-fired:
+		case <-t.wake:
+		case <-t.done:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+
+		select {
+		case <-t.done:
+			return
+		default:
+		}
+	}
+}
+
+// leaseHeap is a container/heap of leases ordered by expiration.
+type leaseHeap []*tableLease
+
+func (h leaseHeap) Len() int {
+	return len(h)
+}
+
+func (h leaseHeap) Less(i, j int) bool {
+	return h[i].Expiration.Before(h[j].Expiration)
+}
+
+func (h leaseHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *leaseHeap) Push(x interface{}) {
+	lease := x.(*tableLease)
+	lease.index = len(*h)
+	*h = append(*h, lease)
+}
+
+func (h *leaseHeap) Pop() interface{} {
+	old := *h
+	lease := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return lease
+}
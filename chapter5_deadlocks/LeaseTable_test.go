@@ -0,0 +1,227 @@
+package chapter5_deadlocks
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+const tableSize = 100000
+
+func TestLeaseTable(t *testing.T) {
+	clock := NewManualClock(time.Unix(0, 0))
+	table := NewLeaseTableWithClock(testTTL, clock)
+	defer table.Close()
+
+	a, err := table.Acquire("a", "Alice")
+	if err != nil {
+		t.Fatalf("Acquire(a): %v", err)
+	}
+	if _, err := table.Acquire("a", "Bob"); err == nil {
+		t.Fatalf("Bob acquired the lease on a that Alice holds")
+	}
+	b, err := table.Acquire("b", "Bob")
+	if err != nil {
+		t.Fatalf("Acquire(b): %v", err)
+	}
+	if b <= a {
+		t.Fatalf("Acquire(b) got token %d, want more than %d", b, a)
+	}
+
+	if err := table.Renew("a", "Alice", b, testTTL); err == nil {
+		t.Fatalf("Renew() with the token of another resource succeeded")
+	}
+	clock.Advance(time.Second)
+	if err := table.Renew("a", "Alice", a, time.Minute); err != nil {
+		t.Fatalf("Renew(a): %v", err)
+	}
+
+	want := []LeaseInfo{
+		{Name: "a", Holder: "Alice", Token: a, Expiration: clock.Now().Add(time.Minute)},
+		{Name: "b", Holder: "Bob", Token: b, Expiration: clock.Now().Add(testTTL - time.Second)},
+	}
+	if got := table.List(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("List() = %v, want %v", got, want)
+	}
+
+	if err := table.Release("a", "Bob", a); err == nil {
+		t.Fatalf("Release() by another holder succeeded")
+	}
+	if err := table.Release("a", "Alice", a); err != nil {
+		t.Fatalf("Release(a): %v", err)
+	}
+	if n := table.Len(); n != 1 {
+		t.Fatalf("Len() after releasing a = %d, want 1", n)
+	}
+
+	// The token of a released resource keeps increasing although its entry
+	// is gone.
+	again, err := table.Acquire("a", "Bob")
+	if err != nil {
+		t.Fatalf("Acquire(a) after release: %v", err)
+	}
+	if again <= b {
+		t.Fatalf("Acquire(a) after release got token %d, want more than %d", again, b)
+	}
+}
+
+func TestLeaseTableSweepsExpiredLeases(t *testing.T) {
+	clock := NewManualClock(time.Unix(0, 0))
+	table := NewLeaseTableWithClock(testTTL, clock)
+	defer table.Close()
+
+	for _, name := range []string{"a", "b", "c"} {
+		if _, err := table.Acquire(name, "Alice"); err != nil {
+			t.Fatalf("Acquire(%s): %v", name, err)
+		}
+	}
+	token, err := table.Acquire("long", "Bob")
+	if err != nil {
+		t.Fatalf("Acquire(long): %v", err)
+	}
+	if err := table.Renew("long", "Bob", token, time.Minute); err != nil {
+		t.Fatalf("Renew(long): %v", err)
+	}
+
+	clock.Advance(testTTL - time.Nanosecond)
+	if n := table.Len(); n != 4 {
+		t.Fatalf("Len() before expiry = %d, want 4", n)
+	}
+	clock.Advance(time.Nanosecond)
+	waitForLen(t, table, 1)
+	if list := table.List(); len(list) != 1 || list[0].Name != "long" {
+		t.Fatalf("List() after expiry = %v, want only long", list)
+	}
+
+	clock.Advance(time.Minute)
+	waitForLen(t, table, 0)
+}
+
+func TestLeaseTableSweeperWakesForEarlierExpiry(t *testing.T) {
+	clock := NewManualClock(time.Unix(0, 0))
+	table := NewLeaseTableWithClock(time.Hour, clock)
+	defer table.Close()
+
+	token, err := table.Acquire("a", "Alice")
+	if err != nil {
+		t.Fatalf("Acquire(): %v", err)
+	}
+	// Shorten the lease after the sweeper armed its timer for the hour.
+	if err := table.Renew("a", "Alice", token, time.Second); err != nil {
+		t.Fatalf("Renew(): %v", err)
+	}
+
+	clock.Advance(time.Second)
+	waitForLen(t, table, 0)
+}
+
+func TestLeaseTableSweepsManyLeases(t *testing.T) {
+	clock := NewManualClock(time.Unix(0, 0))
+	table := NewLeaseTableWithClock(testTTL, clock)
+	defer table.Close()
+
+	for i := 0; i < tableSize; i++ {
+		if _, err := table.Acquire(fmt.Sprintf("resource-%d", i), "Alice"); err != nil {
+			t.Fatalf("Acquire(): %v", err)
+		}
+		if i%1000 == 0 {
+			clock.Advance(time.Millisecond)
+		}
+	}
+	if n := len(table.List()); n != tableSize {
+		t.Fatalf("List() has %d leases, want %d", n, tableSize)
+	}
+
+	clock.Advance(testTTL)
+	if n := len(table.List()); n != 0 {
+		t.Fatalf("List() after expiry has %d leases, want 0", n)
+	}
+	clock.Advance(time.Second)
+	waitForLen(t, table, 0)
+}
+
+func BenchmarkLeaseTableAcquireRelease(b *testing.B) {
+	table := newFullTable(b)
+	defer table.Close()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		token, err := table.Acquire("extra", "Bob")
+		if err != nil {
+			b.Fatalf("Acquire(): %v", err)
+		}
+		if err := table.Release("extra", "Bob", token); err != nil {
+			b.Fatalf("Release(): %v", err)
+		}
+	}
+}
+
+func BenchmarkLeaseTableRenew(b *testing.B) {
+	table := newFullTable(b)
+	defer table.Close()
+	leases := table.List()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		lease := leases[i%len(leases)]
+		if err := table.Renew(lease.Name, lease.Holder, lease.Token, time.Hour); err != nil {
+			b.Fatalf("Renew(): %v", err)
+		}
+	}
+}
+
+func BenchmarkLeaseTableList(b *testing.B) {
+	table := newFullTable(b)
+	defer table.Close()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		table.List()
+	}
+}
+
+// BenchmarkLeaseTableSweep measures how long the sweeper takes to expire a
+// table of 100k leases.
+func BenchmarkLeaseTableSweep(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		clock := NewManualClock(time.Unix(0, 0))
+		table := NewLeaseTableWithClock(time.Hour, clock)
+		fill(b, table)
+		b.StartTimer()
+
+		clock.Advance(time.Hour)
+		waitForLen(b, table, 0)
+
+		b.StopTimer()
+		table.Close()
+	}
+}
+
+// newFullTable creates a LeaseTable that holds 100k leases.
+func newFullTable(tb testing.TB) *LeaseTable {
+	table := NewLeaseTable(time.Hour)
+	fill(tb, table)
+	return table
+}
+
+func fill(tb testing.TB, table *LeaseTable) {
+	for i := 0; i < tableSize; i++ {
+		if _, err := table.Acquire(fmt.Sprintf("resource-%d", i), "Alice"); err != nil {
+			tb.Fatalf("Acquire(): %v", err)
+		}
+	}
+}
+
+// waitForLen waits for the sweeper to shrink table to n entries.
+func waitForLen(tb testing.TB, table *LeaseTable, n int) {
+	tb.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for table.Len() != n {
+		if time.Now().After(deadline) {
+			tb.Fatalf("Len() = %d, want the sweeper to leave %d", table.Len(), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
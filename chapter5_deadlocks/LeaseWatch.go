@@ -0,0 +1,271 @@
+package chapter5_deadlocks
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// LeaseEventKind is what happened to a lease.
+type LeaseEventKind int
+
+const (
+	// LeaseAcquired means that Holder acquired the lease with Token.
+	LeaseAcquired LeaseEventKind = iota + 1
+
+	// LeaseRenewed means that Holder renewed the lease it holds with Token.
+	LeaseRenewed
+
+	// LeaseReleased means that Holder released the lease it held with Token.
+	LeaseReleased
+
+	// LeaseExpired means that the lease Holder held with Token expired
+	// before it was renewed or released.
+	LeaseExpired
+
+	// LeaseStolen means that another holder acquired the lease that Holder
+	// held with Token after it expired. It is followed by LeaseAcquired for
+	// the new holder.
+	LeaseStolen
+)
+
+func (k LeaseEventKind) String() string {
+	switch k {
+	case LeaseAcquired:
+		return "acquired"
+	case LeaseRenewed:
+		return "renewed"
+	case LeaseReleased:
+		return "released"
+	case LeaseExpired:
+		return "expired"
+	case LeaseStolen:
+		return "stolen"
+	}
+	return "unknown"
+}
+
+// LeaseEvent is a change of a lease.
+type LeaseEvent struct {
+	Kind   LeaseEventKind
+	Holder string
+	Token  uint64
+
+	// At is when the change happened, as told by the lease's clock.
+	At time.Time
+}
+
+// Watch returns a channel that receives every change of the lease from now
+// on, in order. The channel is closed when ctx is done. Events are queued for
+// slow receivers rather than dropped.
+func (l *ThreadSafeLease) Watch(ctx context.Context) <-chan LeaseEvent {
+	w := &leaseWatcher{signal: make(chan struct{}, 1)}
+	events := make(chan LeaseEvent)
+
+	l.mu.Lock()
+	if l.watchers == nil {
+		l.watchers = make(map[*leaseWatcher]struct{})
+	}
+	l.watchers[w] = struct{}{}
+	l.mu.Unlock()
+
+	go func() {
+		defer close(events)
+		w.forward(ctx, events)
+
+		l.mu.Lock()
+		delete(l.watchers, w)
+		l.mu.Unlock()
+	}()
+	return events
+}
+
+// AcquireWait acquires the lease for holder, waiting until it is released or
+// expires if it is held. Waiters acquire the lease in the order they called
+// AcquireWait. If ctx is done first, AcquireWait returns ctx.Err().
+func (l *ThreadSafeLease) AcquireWait(ctx context.Context, holder string) (uint64, error) {
+	l.mu.Lock()
+	now := l.now()
+	l.settle(now)
+	if l.holder == "" || l.expired(now) {
+		token := l.grant(holder, nil, now)
+		l.mu.Unlock()
+		return token, nil
+	}
+
+	w := &leaseWaiter{holder: holder, granted: make(chan struct{})}
+	l.waiters = append(l.waiters, w)
+	l.mu.Unlock()
+
+	select {
+	case <-w.granted:
+		return w.token, nil
+	case <-ctx.Done():
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	select {
+	case <-w.granted:
+		// The lease was handed over as ctx was done. Pass it on.
+		if l.holder == w.holder && l.token == w.token {
+			l.release(l.now())
+		}
+	default:
+		for i, waiter := range l.waiters {
+			if waiter == w {
+				l.waiters = append(l.waiters[:i], l.waiters[i+1:]...)
+				break
+			}
+		}
+	}
+	return 0, ctx.Err()
+}
+
+// grant gives the lease to holder at now, through session if it is not nil,
+// and returns its token. The caller holds l.mu, has checked that the lease is
+// free and has attached the lease to session.
+func (l *ThreadSafeLease) grant(holder string, session *Session, now time.Time) uint64 {
+	if l.holder != "" && l.holder != holder {
+		l.emit(LeaseStolen, l.holder, l.token, now)
+	}
+	l.detach()
+
+	l.holder = holder
+	l.lastToken++
+	l.token = l.lastToken
+	l.expiration = now.Add(l.ttl)
+	l.session = session
+	l.expiredSent = false
+	l.arm(now)
+	l.emit(LeaseAcquired, holder, l.token, now)
+
+	return l.token
+}
+
+// release frees the lease at now and hands it to the first waiter, if any.
+func (l *ThreadSafeLease) release(now time.Time) {
+	holder, token := l.holder, l.token
+	l.holder = ""
+	l.token = 0
+	l.expiration = time.Time{}
+	l.detach()
+	if l.timer != nil {
+		l.timer.Stop()
+		l.timer = nil
+	}
+	l.emit(LeaseReleased, holder, token, now)
+
+	l.handOff(now)
+}
+
+// settle tells watchers if the lease expired by now and hands it to the
+// first waiter, if any.
+func (l *ThreadSafeLease) settle(now time.Time) {
+	if l.holder == "" || !l.expired(now) {
+		return
+	}
+	if !l.expiredSent {
+		l.expiredSent = true
+		l.emit(LeaseExpired, l.holder, l.token, now)
+	}
+	l.handOff(now)
+}
+
+func (l *ThreadSafeLease) handOff(now time.Time) {
+	if len(l.waiters) == 0 {
+		return
+	}
+	w := l.waiters[0]
+	l.waiters[0] = nil
+	l.waiters = l.waiters[1:]
+
+	w.token = l.grant(w.holder, nil, now)
+	close(w.granted)
+}
+
+// arm sets the timer that settles the lease when it expires. The session of
+// a lease held through one settles it instead.
+func (l *ThreadSafeLease) arm(now time.Time) {
+	if l.timer != nil {
+		l.timer.Stop()
+		l.timer = nil
+	}
+	if l.session != nil {
+		return
+	}
+	l.timer = l.clockOrReal().AfterFunc(l.expiration.Sub(now), func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+
+		l.settle(l.now())
+	})
+}
+
+// detach removes the lease from its session, if any.
+func (l *ThreadSafeLease) detach() {
+	if l.session != nil {
+		l.session.detach(l)
+		l.session = nil
+	}
+}
+
+func (l *ThreadSafeLease) emit(kind LeaseEventKind, holder string, token uint64, now time.Time) {
+	event := LeaseEvent{Kind: kind, Holder: holder, Token: token, At: now}
+	for w := range l.watchers {
+		w.push(event)
+	}
+}
+
+// leaseWaiter is a caller of AcquireWait.
+type leaseWaiter struct {
+	holder string
+
+	// token is set before granted is closed.
+	token   uint64
+	granted chan struct{}
+}
+
+// leaseWatcher queues the events of a Watch channel, so that the lease never
+// blocks on a slow receiver.
+type leaseWatcher struct {
+	mu     sync.Mutex
+	queue  []LeaseEvent
+	signal chan struct{}
+}
+
+func (w *leaseWatcher) push(event LeaseEvent) {
+	w.mu.Lock()
+	w.queue = append(w.queue, event)
+	w.mu.Unlock()
+
+	select {
+	case w.signal <- struct{}{}:
+	default:
+	}
+}
+
+// forward sends the queued events to events until ctx is done.
+func (w *leaseWatcher) forward(ctx context.Context, events chan<- LeaseEvent) {
+	for {
+		w.mu.Lock()
+		queue := w.queue
+		w.queue = nil
+		w.mu.Unlock()
+
+		for _, event := range queue {
+			select {
+			case events <- event:
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		select {
+		case <-w.signal:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package chapter5_deadlocks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestThreadSafeLeaseWatch(t *testing.T) {
+	clock := NewManualClock(time.Unix(0, 0))
+	lease := NewThreadSafeLeaseWithClock(testTTL, clock)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := lease.Watch(ctx)
+
+	alice := mustAcquire(t, lease, "Alice")
+	if err := lease.Renew("Alice", alice, testTTL); err != nil {
+		t.Fatalf("Renew(): %v", err)
+	}
+	if err := lease.Release("Alice", alice); err != nil {
+		t.Fatalf("Release(): %v", err)
+	}
+	bob := mustAcquire(t, lease, "Bob")
+	clock.Advance(testTTL)
+	expectEvent(t, events, LeaseAcquired, "Alice", alice)
+	expectEvent(t, events, LeaseRenewed, "Alice", alice)
+	expectEvent(t, events, LeaseReleased, "Alice", alice)
+	expectEvent(t, events, LeaseAcquired, "Bob", bob)
+	expectEvent(t, events, LeaseExpired, "Bob", bob)
+
+	carol := mustAcquire(t, lease, "Carol")
+	expectEvent(t, events, LeaseStolen, "Bob", bob)
+	expectEvent(t, events, LeaseAcquired, "Carol", carol)
+
+	cancel()
+	for event := range events {
+		t.Fatalf("event %v after the watch was cancelled", event)
+	}
+}
+
+func TestThreadSafeLeaseReacquireAfterExpiryIsNotStolen(t *testing.T) {
+	clock := NewManualClock(time.Unix(0, 0))
+	lease := NewThreadSafeLeaseWithClock(testTTL, clock)
+	first := mustAcquire(t, lease, "Alice")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := lease.Watch(ctx)
+
+	clock.Advance(testTTL)
+	expectEvent(t, events, LeaseExpired, "Alice", first)
+	second := mustAcquire(t, lease, "Alice")
+	expectEvent(t, events, LeaseAcquired, "Alice", second)
+}
+
+func TestAcquireWaitIsFIFO(t *testing.T) {
+	const waiters = 5
+
+	lease := NewThreadSafeLease(time.Minute)
+	token := mustAcquire(t, lease, "holder")
+
+	type grant struct {
+		holder string
+		token  uint64
+	}
+	granted := make(chan grant)
+	for i := 0; i < waiters; i++ {
+		holder := fmt.Sprintf("waiter-%d", i)
+		go func() {
+			token, err := lease.AcquireWait(context.Background(), holder)
+			if err != nil {
+				t.Errorf("AcquireWait(%s): %v", holder, err)
+				return
+			}
+			granted <- grant{holder, token}
+		}()
+		waitForWaiters(t, lease, i+1)
+	}
+
+	holder := "holder"
+	for i := 0; i < waiters; i++ {
+		if err := lease.Release(holder, token); err != nil {
+			t.Fatalf("Release(%s): %v", holder, err)
+		}
+		next := <-granted
+		if want := fmt.Sprintf("waiter-%d", i); next.holder != want {
+			t.Fatalf("lease was handed to %s, want %s", next.holder, want)
+		}
+		if next.token <= token {
+			t.Fatalf("%s got token %d, want more than %d", next.holder, next.token, token)
+		}
+		holder, token = next.holder, next.token
+	}
+}
+
+func TestAcquireWaitWakesOnExpiry(t *testing.T) {
+	clock := NewManualClock(time.Unix(0, 0))
+	lease := NewThreadSafeLeaseWithClock(testTTL, clock)
+	alice := mustAcquire(t, lease, "Alice")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := lease.Watch(ctx)
+
+	acquired := make(chan uint64, 1)
+	go func() {
+		token, err := lease.AcquireWait(context.Background(), "Bob")
+		if err != nil {
+			t.Errorf("AcquireWait(): %v", err)
+		}
+		acquired <- token
+	}()
+	waitForWaiters(t, lease, 1)
+
+	clock.Advance(testTTL)
+	bob := <-acquired
+	expectEvent(t, events, LeaseExpired, "Alice", alice)
+	expectEvent(t, events, LeaseStolen, "Alice", alice)
+	expectEvent(t, events, LeaseAcquired, "Bob", bob)
+
+	if err := lease.Renew("Alice", alice, testTTL); err == nil {
+		t.Fatalf("Alice renewed the lease that was handed to Bob")
+	}
+}
+
+func TestAcquireWaitGivesUpWithContext(t *testing.T) {
+	lease := NewThreadSafeLease(time.Minute)
+	alice := mustAcquire(t, lease, "Alice")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	failed := make(chan error, 1)
+	go func() {
+		_, err := lease.AcquireWait(ctx, "Bob")
+		failed <- err
+	}()
+	waitForWaiters(t, lease, 1)
+
+	cancel()
+	if err := <-failed; !errors.Is(err, context.Canceled) {
+		t.Fatalf("AcquireWait() after cancel = %v, want %v", err, context.Canceled)
+	}
+	waitForWaiters(t, lease, 0)
+
+	if err := lease.Release("Alice", alice); err != nil {
+		t.Fatalf("Release(): %v", err)
+	}
+	if lease.IsHeld() {
+		t.Fatalf("lease was handed to %s, who gave up waiting", lease.Holder())
+	}
+}
+
+func expectEvent(t *testing.T, events <-chan LeaseEvent, kind LeaseEventKind, holder string, token uint64) {
+	t.Helper()
+
+	select {
+	case event := <-events:
+		if event.Kind != kind || event.Holder != holder || event.Token != token {
+			t.Fatalf("event = %s by %s with token %d, want %s by %s with token %d",
+				event.Kind, event.Holder, event.Token, kind, holder, token)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no event, want %s by %s with token %d", kind, holder, token)
+	}
+}
+
+// waitForWaiters waits until n callers of AcquireWait are queued for lease.
+func waitForWaiters(t *testing.T, lease *ThreadSafeLease, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		lease.mu.RLock()
+		queued := len(lease.waiters)
+		lease.mu.RUnlock()
+		if queued == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d waiters are queued, want %d", queued, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -15,28 +15,51 @@ type Lease struct {
 
 	// token is a unique token that is assigned to the holder of the lease.
 	// The token can be used to prove that the holder is the current holder of the lease.
-	token string
+	// Every acquisition is assigned a larger token than the one before it, so the token
+	// doubles as a fencing token.
+	token uint64
+
+	// lastToken is the token assigned by the latest acquisition. It survives releases
+	// and expirations, so tokens keep increasing.
+	lastToken uint64
 
 	// ttl is the time-to-live for the lease. After the lease expires, it can be acquired by another holder.
 	ttl time.Duration
 
 	// expiration is the time at which the lease expires.
 	expiration time.Time
+
+	// clock tells the time. A nil clock is RealClock.
+	clock Clock
+}
+
+// NewLease creates a lease that is valid for ttl after every acquisition.
+func NewLease(ttl time.Duration) *Lease {
+	return &Lease{ttl: ttl}
+}
+
+// NewLeaseWithClock creates a lease that is valid for ttl after every
+// acquisition, as told by clock.
+func NewLeaseWithClock(ttl time.Duration, clock Clock) *Lease {
+	return &Lease{ttl: ttl, clock: clock}
 }
 
 // Acquire acquires the lease and returns a unique token that can be used to prove that the caller is the holder of the lease.
+// Tokens strictly increase with every acquisition and do not depend on the clock.
 // If the lease is already held by another holder, this function will return an error.
-func (l *Lease) Acquire(holder string) (string, error) {
+func (l *Lease) Acquire(holder string) (uint64, error) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
-	if l.holder != "" && time.Now().Before(l.expiration) {
-		return "", fmt.Errorf("lease already held by %s", l.holder)
+	now := l.now()
+	if l.holder != "" && !l.expired(now) {
+		return 0, fmt.Errorf("lease already held by %s", l.holder)
 	}
 
 	l.holder = holder
-	l.token = fmt.Sprintf("%d", time.Now().UnixNano())
-	l.expiration = time.Now().Add(l.ttl)
+	l.lastToken++
+	l.token = l.lastToken
+	l.expiration = now.Add(l.ttl)
 
 	return l.token, nil
 }
@@ -44,15 +67,16 @@ func (l *Lease) Acquire(holder string) (string, error) {
 // Renew renews the lease and extends the expiration time by the specified time-to-live (TTL).
 // The holder must provide the unique token that was returned when the lease was acquired.
 // If the token is invalid or the lease has already expired, this function will return an error.
-func (l *Lease) Renew(holder, token string, ttl time.Duration) error {
+func (l *Lease) Renew(holder string, token uint64, ttl time.Duration) error {
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
-	if l.holder != holder || l.token != token || time.Now().After(l.expiration) {
+	now := l.now()
+	if l.holder != holder || l.token != token || l.expired(now) {
 		return fmt.Errorf("invalid token or lease has expired")
 	}
 
-	l.expiration = time.Now().Add(ttl)
+	l.expiration = now.Add(ttl)
 
 	return nil
 }
@@ -60,67 +84,44 @@ func (l *Lease) Renew(holder, token string, ttl time.Duration) error {
 // Release releases the lease and allows another holder to acquire it.
 // The holder must provide the unique token that was returned when the lease was acquired.
 // If the token is invalid or the lease has already expired, this function will return an error.
-func (l *Lease) Release(holder, token string) error {
+func (l *Lease) Release(holder string, token uint64) error {
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
-	if l.holder != holder || l.token != token || time.Now().After(l.expiration) {
+	if l.holder != holder || l.token != token || l.expired(l.now()) {
 		return fmt.Errorf("invalid token or lease has expired")
 	}
 
 	l.holder = ""
-	l.token = ""
+	l.token = 0
 	l.expiration = time.Time{}
 
 	return nil
 }
 
-func main() {
-	// Create a new lease with a TTL of 5 seconds.
-	lease := &Lease{ttl: 5 * time.Second}
-
-	// Try to acquire the lease as holder "Alice".
-	token, err := lease.Acquire("Alice")
-	if err != nil {
-		fmt.Println(err)
-		return
-	}
-	fmt.Println("Lease acquired by Alice with token", token)
-
-	// Try to renew the lease as holder "Bob". This should fail because "Bob" is not the current holder.
-	err = lease.Renew("Bob", token, 5*time.Second)
-	if err != nil {
-		fmt.Println(err)
-	}
-
-	// Try to renew the lease as holder "Alice" with the correct token.
-	err = lease.Renew("Alice", token, 5*time.Second)
-	if err != nil {
-		fmt.Println(err)
-		return
-	}
-	fmt.Println("Lease renewed by Alice")
-
-	// Wait for the lease to expire.
-	time.Sleep(6 * time.Second)
+// remaining returns how much longer the lease is held by holder with token,
+// or zero if it is not.
+func (l *Lease) remaining(holder string, token uint64) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
 
-	// Try to renew the lease as holder "Alice". This should fail because the lease has expired.
-	err = lease.Renew("Alice", token, 5*time.Second)
-	if err != nil {
-		fmt.Println(err)
+	now := l.now()
+	if l.holder != holder || l.token != token || l.expired(now) {
+		return 0
 	}
+	return l.expiration.Sub(now)
+}
 
-	// Try to release the lease as holder "Bob". This should fail because "Bob" is not the current holder.
-	err = lease.Release("Bob", token)
-	if err != nil {
-		fmt.Println(err)
+// now returns the current time of the lease's clock.
+func (l *Lease) now() time.Time {
+	if l.clock == nil {
+		return RealClock.Now()
 	}
+	return l.clock.Now()
+}
 
-	// Try to release the lease as holder "Alice" with the correct token.
-	err = lease.Release("Alice", token)
-	if err != nil {
-		fmt.Println(err)
-		return
-	}
-	fmt.Println("Lease released by Alice")
+// expired reports whether the lease has expired at now. A lease expires at its
+// expiration time, not after it.
+func (l *Lease) expired(now time.Time) bool {
+	return !now.Before(l.expiration)
 }
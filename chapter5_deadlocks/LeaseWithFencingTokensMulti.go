@@ -2,7 +2,6 @@ package chapter5_deadlocks
 
 import (
 	"fmt"
-	"math/rand"
 	"sync"
 	"time"
 )
@@ -15,44 +14,88 @@ type ThreadSafeLease struct {
 
 	// token is a unique token that is assigned to the holder of the lease.
 	// The token can be used to prove that the holder is the current holder of the lease.
-	token string
+	// Every acquisition is assigned a larger token than the one before it, so the token
+	// doubles as a fencing token.
+	token uint64
+
+	// lastToken is the token assigned by the latest acquisition. It survives releases
+	// and expirations, so tokens keep increasing.
+	lastToken uint64
 
 	// ttl is the time-to-live for the lease. After the lease expires, it can be acquired by another holder.
 	ttl time.Duration
 
-	// expiration is the time at which the lease expires.
+	// expiration is the time at which the lease expires, unless it is held
+	// through a session.
 	expiration time.Time
+
+	// session is the Session the lease is held through, if any. The lease then
+	// expires when the session does.
+	session *Session
+
+	// clock tells the time. A nil clock is RealClock.
+	clock Clock
+
+	// timer expires the lease when it is held, so that watchers and waiters
+	// learn about the expiration without polling.
+	timer Timer
+
+	// expiredSent is whether watchers were told that the current holder's lease expired.
+	expiredSent bool
+
+	// watchers receive the changes of the lease.
+	watchers map[*leaseWatcher]struct{}
+
+	// waiters wait in AcquireWait for the lease, in the order they arrived.
+	waiters []*leaseWaiter
+}
+
+// NewThreadSafeLease creates a lease that is valid for ttl after every
+// acquisition.
+func NewThreadSafeLease(ttl time.Duration) *ThreadSafeLease {
+	return &ThreadSafeLease{ttl: ttl}
+}
+
+// NewThreadSafeLeaseWithClock creates a lease that is valid for ttl after
+// every acquisition, as told by clock.
+func NewThreadSafeLeaseWithClock(ttl time.Duration, clock Clock) *ThreadSafeLease {
+	return &ThreadSafeLease{ttl: ttl, clock: clock}
 }
 
 // Acquire acquires the lease and returns a unique token that can be used to prove that the caller is the holder of the lease.
+// Tokens strictly increase with every acquisition and do not depend on the clock.
 // If the lease is already held by another holder, this function will return an error.
-func (l *ThreadSafeLease) Acquire(holder string) (string, error) {
+func (l *ThreadSafeLease) Acquire(holder string) (uint64, error) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
-	if l.holder != "" && time.Now().Before(l.expiration) {
-		return "", fmt.Errorf("lease already held by %s", l.holder)
+	now := l.now()
+	l.settle(now)
+	if l.holder != "" && !l.expired(now) {
+		return 0, fmt.Errorf("lease already held by %s", l.holder)
 	}
 
-	l.holder = holder
-	l.token = fmt.Sprintf("%d", time.Now().UnixNano())
-	l.expiration = time.Now().Add(l.ttl)
-
-	return l.token, nil
+	return l.grant(holder, nil, now), nil
 }
 
 // Renew renews the lease and extends the expiration time by the specified time-to-live (TTL).
 // The holder must provide the unique token that was returned when the lease was acquired.
 // If the token is invalid or the lease has already expired, this function will return an error.
-func (l *ThreadSafeLease) Renew(holder, token string, ttl time.Duration) error {
+func (l *ThreadSafeLease) Renew(holder string, token uint64, ttl time.Duration) error {
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
-	if l.holder != holder || l.token != token || time.Now().After(l.expiration) {
+	now := l.now()
+	if l.holder != holder || l.token != token || l.expired(now) {
 		return fmt.Errorf("invalid token or lease has expired")
 	}
+	if l.session != nil {
+		return fmt.Errorf("lease is kept alive by its session")
+	}
 
-	l.expiration = time.Now().Add(ttl)
+	l.expiration = now.Add(ttl)
+	l.arm(now)
+	l.emit(LeaseRenewed, holder, token, now)
 
 	return nil
 }
@@ -60,18 +103,16 @@ func (l *ThreadSafeLease) Renew(holder, token string, ttl time.Duration) error {
 // Release releases the lease and allows another holder to acquire it.
 // The holder must provide the unique token that was returned when the lease was acquired.
 // If the token is invalid or the lease has already expired, this function will return an error.
-func (l *ThreadSafeLease) Release(holder, token string) error {
+func (l *ThreadSafeLease) Release(holder string, token uint64) error {
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
-	if l.holder != holder || l.token != token || time.Now().After(l.expiration) {
+	now := l.now()
+	if l.holder != holder || l.token != token || l.expired(now) {
 		return fmt.Errorf("invalid token or lease has expired")
 	}
 
-	l.holder = ""
-	l.token = ""
-	l.expiration = time.Time{}
-
+	l.release(now)
 	return nil
 }
 
@@ -80,7 +121,7 @@ func (l *ThreadSafeLease) IsHeld() bool {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
 
-	return l.holder != "" && time.Now().Before(l.expiration)
+	return l.holder != "" && !l.expired(l.now())
 }
 
 // Holder returns the current holder of the lease. If the lease is not currently held, this function will return an empty string.
@@ -88,20 +129,20 @@ func (l *ThreadSafeLease) Holder() string {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
 
-	if l.holder == "" || time.Now().After(l.expiration) {
+	if l.holder == "" || l.expired(l.now()) {
 		return ""
 	}
 
 	return l.holder
 }
 
-// Token returns the unique token that is assigned to the holder of the lease. If the lease is not currently held, this function will return an empty string.
-func (l *ThreadSafeLease) Token() string {
+// Token returns the unique token that is assigned to the holder of the lease. If the lease is not currently held, this function will return zero.
+func (l *ThreadSafeLease) Token() uint64 {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
 
-	if l.holder == "" || time.Now().After(l.expiration) {
-		return ""
+	if l.holder == "" || l.expired(l.now()) {
+		return 0
 	}
 
 	return l.token
@@ -112,7 +153,7 @@ func (l *ThreadSafeLease) TTLExpired() bool {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
 
-	return time.Now().After(l.expiration)
+	return l.expired(l.now())
 }
 
 // RemainingTTL returns the remaining time-to-live for the lease. If the lease has expired, this function will return a negative value.
@@ -120,61 +161,44 @@ func (l *ThreadSafeLease) RemainingTTL() time.Duration {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
 
-	return l.expiration.Sub(time.Now())
-}
-
-func main() {
-	// Create a new lease with a TTL of 5 seconds.
-	lease := &ThreadSafeLease{ttl: 5 * time.Second}
-
-	// Start a goroutine that continuously tries to acquire the lease as holder "Alice".
-	go func() {
-		for {
-			token, err := lease.Acquire("Alice")
-			if err != nil {
-				fmt.Println("Alice failed to acquire lease:", err)
-				time.Sleep(100 * time.Millisecond)
-				continue
-			}
-			fmt.Println("Alice acquired lease with token", token)
-
-			// Sleep for a random duration between 1 and 3 seconds.
-			time.Sleep(time.Duration(1+rand.Intn(3)) * time.Second)
-
-			// Try to release the lease.
-			err = lease.Release("Alice", token)
-			if err != nil {
-				fmt.Println("Alice failed to release lease:", err)
-			} else {
-				fmt.Println("Alice released lease")
-			}
-		}
-	}()
-
-	// Start a goroutine that continuously tries to acquire the lease as holder "Bob".
-	go func() {
-		for {
-			token, err := lease.Acquire("Bob")
-			if err != nil {
-				fmt.Println("Bob failed to acquire lease:", err)
-				time.Sleep(100 * time.Millisecond)
-				continue
-			}
-			fmt.Println("Bob acquired lease with token", token)
-
-			// Sleep for a random duration between 1 and 3 seconds.
-			time.Sleep(time.Duration(1+rand.Intn(3)) * time.Second)
-
-			// Try to release the lease.
-			err = lease.Release("Bob", token)
-			if err != nil {
-				fmt.Println("Bob failed to release lease:", err)
-			} else {
-				fmt.Println("Bob released lease")
-			}
-		}
-	}()
-
-	// Sleep for 20 seconds to allow the goroutines to run.
-	time.Sleep(20 * time.Second)
+	return l.deadline().Sub(l.now())
+}
+
+// remaining returns how much longer the lease is held by holder with token,
+// or zero if it is not.
+func (l *ThreadSafeLease) remaining(holder string, token uint64) time.Duration {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	now := l.now()
+	if l.holder != holder || l.token != token || l.expired(now) {
+		return 0
+	}
+	return l.deadline().Sub(now)
+}
+
+// now returns the current time of the lease's clock.
+func (l *ThreadSafeLease) now() time.Time {
+	return l.clockOrReal().Now()
+}
+
+func (l *ThreadSafeLease) clockOrReal() Clock {
+	if l.clock == nil {
+		return RealClock
+	}
+	return l.clock
+}
+
+// expired reports whether the lease has expired at now. A lease expires at its
+// expiration time, not after it.
+func (l *ThreadSafeLease) expired(now time.Time) bool {
+	return !now.Before(l.deadline())
+}
+
+// deadline returns the time at which the lease expires.
+func (l *ThreadSafeLease) deadline() time.Time {
+	if l.session != nil {
+		return l.session.deadline()
+	}
+	return l.expiration
 }
@@ -0,0 +1,208 @@
+package chapter5_deadlocks
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testTTL = 10 * time.Second
+
+// leaseTypes creates each lease type on a manual clock.
+var leaseTypes = []struct {
+	name     string
+	newLease func(ttl time.Duration, clock Clock) lease
+}{
+	{"Lease", func(ttl time.Duration, clock Clock) lease { return NewLeaseWithClock(ttl, clock) }},
+	{"ThreadSafeLease", func(ttl time.Duration, clock Clock) lease { return NewThreadSafeLeaseWithClock(ttl, clock) }},
+}
+
+func TestLeaseExpiry(t *testing.T) {
+	for _, leaseType := range leaseTypes {
+		t.Run(leaseType.name, func(t *testing.T) {
+			clock := NewManualClock(time.Unix(0, 0))
+			lease := leaseType.newLease(testTTL, clock)
+			token := mustAcquire(t, lease, "Alice")
+
+			clock.Advance(testTTL - time.Nanosecond)
+			if _, err := lease.Acquire("Bob"); err == nil {
+				t.Fatalf("Bob acquired the lease a nanosecond before it expired")
+			}
+			if remaining := lease.remaining("Alice", token); remaining != time.Nanosecond {
+				t.Fatalf("remaining() a nanosecond before expiry = %v, want 1ns", remaining)
+			}
+
+			// The lease expires at its expiration time, not after it.
+			clock.Advance(time.Nanosecond)
+			if remaining := lease.remaining("Alice", token); remaining != 0 {
+				t.Fatalf("remaining() at expiry = %v, want 0", remaining)
+			}
+			if err := lease.Renew("Alice", token, testTTL); err == nil {
+				t.Fatalf("Alice renewed the lease at its expiration time")
+			}
+			if err := lease.Release("Alice", token); err == nil {
+				t.Fatalf("Alice released the lease at its expiration time")
+			}
+
+			bobToken := mustAcquire(t, lease, "Bob")
+			if bobToken <= token {
+				t.Fatalf("Bob got token %d, want more than Alice's %d", bobToken, token)
+			}
+			if err := lease.Renew("Alice", token, testTTL); err == nil {
+				t.Fatalf("Alice renewed the lease that Bob holds")
+			}
+		})
+	}
+}
+
+func TestLeaseRenew(t *testing.T) {
+	for _, leaseType := range leaseTypes {
+		t.Run(leaseType.name, func(t *testing.T) {
+			clock := NewManualClock(time.Unix(0, 0))
+			lease := leaseType.newLease(testTTL, clock)
+			token := mustAcquire(t, lease, "Alice")
+
+			if err := lease.Renew("Alice", token+1, testTTL); err == nil {
+				t.Fatalf("Renew() with the wrong token succeeded")
+			}
+			if err := lease.Renew("Bob", token, testTTL); err == nil {
+				t.Fatalf("Renew() by another holder succeeded")
+			}
+
+			// Renewing at the last moment extends the lease from now, not
+			// from the old expiration.
+			clock.Advance(testTTL - time.Nanosecond)
+			if err := lease.Renew("Alice", token, time.Minute); err != nil {
+				t.Fatalf("Renew() a nanosecond before expiry: %v", err)
+			}
+			if remaining := lease.remaining("Alice", token); remaining != time.Minute {
+				t.Fatalf("remaining() after renewing for 1m = %v", remaining)
+			}
+
+			// Renewing can shorten the lease too.
+			if err := lease.Renew("Alice", token, time.Second); err != nil {
+				t.Fatalf("Renew() for 1s: %v", err)
+			}
+			clock.Advance(time.Second)
+			if _, err := lease.Acquire("Bob"); err != nil {
+				t.Fatalf("Acquire() after the shortened lease expired: %v", err)
+			}
+		})
+	}
+}
+
+func TestLeaseRelease(t *testing.T) {
+	for _, leaseType := range leaseTypes {
+		t.Run(leaseType.name, func(t *testing.T) {
+			clock := NewManualClock(time.Unix(0, 0))
+			lease := leaseType.newLease(testTTL, clock)
+			token := mustAcquire(t, lease, "Alice")
+
+			if err := lease.Release("Bob", token); err == nil {
+				t.Fatalf("Release() by another holder succeeded")
+			}
+			if err := lease.Release("Alice", token); err != nil {
+				t.Fatalf("Release(): %v", err)
+			}
+			if err := lease.Release("Alice", token); err == nil {
+				t.Fatalf("second Release() succeeded")
+			}
+			if err := lease.Renew("Alice", token, testTTL); err == nil {
+				t.Fatalf("Renew() after Release() succeeded")
+			}
+
+			// A released lease can be acquired right away.
+			if next := mustAcquire(t, lease, "Bob"); next <= token {
+				t.Fatalf("Bob got token %d, want more than %d", next, token)
+			}
+		})
+	}
+}
+
+func TestThreadSafeLeaseState(t *testing.T) {
+	clock := NewManualClock(time.Unix(0, 0))
+	lease := NewThreadSafeLeaseWithClock(testTTL, clock)
+
+	if lease.IsHeld() || lease.Holder() != "" || lease.Token() != 0 || !lease.TTLExpired() {
+		t.Fatalf("new lease: IsHeld() = %v, Holder() = %q, Token() = %d, TTLExpired() = %v",
+			lease.IsHeld(), lease.Holder(), lease.Token(), lease.TTLExpired())
+	}
+
+	token := mustAcquire(t, lease, "Alice")
+	clock.Advance(3 * time.Second)
+	if !lease.IsHeld() || lease.Holder() != "Alice" || lease.Token() != token || lease.TTLExpired() {
+		t.Fatalf("held lease: IsHeld() = %v, Holder() = %q, Token() = %d, TTLExpired() = %v",
+			lease.IsHeld(), lease.Holder(), lease.Token(), lease.TTLExpired())
+	}
+	if remaining := lease.RemainingTTL(); remaining != 7*time.Second {
+		t.Fatalf("RemainingTTL() = %v, want 7s", remaining)
+	}
+
+	clock.Advance(8 * time.Second)
+	if lease.IsHeld() || lease.Holder() != "" || lease.Token() != 0 || !lease.TTLExpired() {
+		t.Fatalf("expired lease: IsHeld() = %v, Holder() = %q, Token() = %d, TTLExpired() = %v",
+			lease.IsHeld(), lease.Holder(), lease.Token(), lease.TTLExpired())
+	}
+	if remaining := lease.RemainingTTL(); remaining != -time.Second {
+		t.Fatalf("RemainingTTL() of a lease that expired 1s ago = %v, want -1s", remaining)
+	}
+}
+
+func TestThreadSafeLeaseContention(t *testing.T) {
+	const contenders = 50
+
+	clock := NewManualClock(time.Unix(0, 0))
+	lease := NewThreadSafeLeaseWithClock(testTTL, clock)
+
+	var last uint64
+	for round := 0; round < 5; round++ {
+		var (
+			wg      sync.WaitGroup
+			mu      sync.Mutex
+			winners []string
+			token   uint64
+		)
+		start := make(chan struct{})
+		for i := 0; i < contenders; i++ {
+			holder := fmt.Sprintf("client-%d", i)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-start
+				if got, err := lease.Acquire(holder); err == nil {
+					mu.Lock()
+					winners = append(winners, holder)
+					token = got
+					mu.Unlock()
+				}
+			}()
+		}
+		close(start)
+		wg.Wait()
+
+		if len(winners) != 1 {
+			t.Fatalf("round %d: %d contenders acquired the lease: %v", round, len(winners), winners)
+		}
+		if token <= last {
+			t.Fatalf("round %d: winner got token %d, want more than %d", round, token, last)
+		}
+		if holder := lease.Holder(); holder != winners[0] {
+			t.Fatalf("round %d: Holder() = %q, want the winner %q", round, holder, winners[0])
+		}
+		last = token
+
+		// Nobody releases the lease; the next round starts once it expires.
+		clock.Advance(testTTL)
+	}
+}
+
+func mustAcquire(t *testing.T, lease lease, holder string) uint64 {
+	t.Helper()
+
+	token, err := lease.Acquire(holder)
+	if err != nil {
+		t.Fatalf("%s Acquire(): %v", holder, err)
+	}
+	return token
+}
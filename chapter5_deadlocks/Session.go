@@ -0,0 +1,225 @@
+package chapter5_deadlocks
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrSessionDone is returned when acquiring a lease through a session that
+// has expired or was closed.
+var ErrSessionDone = errors.New("session is done")
+
+// ErrSessionTTL is returned when creating a session with a TTL too short to
+// be kept alive every third of it.
+var ErrSessionTTL = errors.New("session TTL too short to keep alive")
+
+// ErrSessionClock is returned when acquiring a lease through a session that
+// tells the time by a different clock than the lease.
+var ErrSessionClock = errors.New("lease and session use different clocks")
+
+// Session keeps a group of ThreadSafeLeases alive together, like an etcd
+// session. The session has its own TTL and a keep-alive goroutine that
+// renews it every third of the TTL. Leases acquired through the session are
+// valid exactly as long as the session is: if a keep-alive is missed, say
+// because the process was paused, all of them expire at the same instant and
+// Done is closed.
+type Session struct {
+	// ttl is the time-to-live the session is renewed for.
+	ttl time.Duration
+
+	clock Clock
+
+	mu sync.Mutex
+
+	// expiration is the time at which the session expires unless it is renewed.
+	expiration time.Time
+
+	// ended is whether the session expired or was closed.
+	ended bool
+
+	// expiry ends the session when it expires.
+	expiry Timer
+
+	// leases are the leases held through the session.
+	leases map[*ThreadSafeLease]struct{}
+
+	done chan struct{}
+}
+
+// NewSession creates a session that is valid for ttl and starts keeping it
+// alive. Close ends the session.
+func NewSession(ttl time.Duration) (*Session, error) {
+	return NewSessionWithClock(ttl, RealClock)
+}
+
+// NewSessionWithClock creates a session that is valid for ttl, as told by
+// clock, and starts keeping it alive.
+func NewSessionWithClock(ttl time.Duration, clock Clock) (*Session, error) {
+	if ttl/3 <= 0 {
+		return nil, fmt.Errorf("%w: %v", ErrSessionTTL, ttl)
+	}
+
+	s := &Session{
+		ttl:    ttl,
+		clock:  clock,
+		leases: make(map[*ThreadSafeLease]struct{}),
+		done:   make(chan struct{}),
+	}
+
+	s.mu.Lock()
+	keepAlive := s.renewLocked(clock.Now())
+	s.mu.Unlock()
+
+	go s.keepAlive(keepAlive)
+	return s, nil
+}
+
+// Acquire acquires lease for holder through the session and returns its token.
+// The lease cannot be renewed on its own; it is valid as long as the session is.
+// If the lease is already held by another holder, this function will return an error.
+// The lease must tell the time by the session's clock, since it expires when
+// the session does.
+func (s *Session) Acquire(lease *ThreadSafeLease, holder string) (uint64, error) {
+	lease.mu.Lock()
+	defer lease.mu.Unlock()
+
+	if lease.clockOrReal() != s.clock {
+		return 0, ErrSessionClock
+	}
+
+	now := lease.now()
+	lease.settle(now)
+	if lease.holder != "" && !lease.expired(now) {
+		return 0, fmt.Errorf("lease already held by %s", lease.holder)
+	}
+
+	s.mu.Lock()
+	if s.ended || !now.Before(s.expiration) {
+		s.mu.Unlock()
+		return 0, ErrSessionDone
+	}
+	s.leases[lease] = struct{}{}
+	s.mu.Unlock()
+
+	return lease.grant(holder, s, now), nil
+}
+
+// Done returns a channel that is closed when the session expires or is closed.
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// Remaining returns how much longer the session is valid unless it is renewed,
+// or zero if it is done.
+func (s *Session) Remaining() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	remaining := s.expiration.Sub(s.clock.Now())
+	if s.ended || remaining < 0 {
+		return 0
+	}
+	return remaining
+}
+
+// Close ends the session and releases the leases held through it, like
+// revoking an etcd lease.
+func (s *Session) Close() {
+	s.end(true)
+}
+
+// keepAlive renews the session every time timer fires until it is done.
+func (s *Session) keepAlive(timer Timer) {
+	for {
+		select {
+		case <-timer.C():
+		case <-s.done:
+			timer.Stop()
+			return
+		}
+
+		s.mu.Lock()
+		now := s.clock.Now()
+		if s.ended || !now.Before(s.expiration) {
+			// The keep-alive came too late.
+			s.mu.Unlock()
+			s.end(false)
+			return
+		}
+		timer = s.renewLocked(now)
+		s.mu.Unlock()
+	}
+}
+
+// renewLocked makes the session valid for its TTL from now and returns the
+// timer for the next keep-alive.
+func (s *Session) renewLocked(now time.Time) Timer {
+	s.expiration = now.Add(s.ttl)
+	if s.expiry != nil {
+		s.expiry.Stop()
+	}
+	s.expiry = s.clock.AfterFunc(s.ttl, func() {
+		s.mu.Lock()
+		expired := !s.clock.Now().Before(s.expiration)
+		s.mu.Unlock()
+
+		if expired {
+			s.end(false)
+		}
+	})
+	return s.clock.NewTimer(s.ttl / 3)
+}
+
+// end ends the session. The leases held through it are released if revoke
+// is set, and settled as expired otherwise.
+func (s *Session) end(revoke bool) {
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.expiry.Stop()
+	leases := make([]*ThreadSafeLease, 0, len(s.leases))
+	for lease := range s.leases {
+		leases = append(leases, lease)
+	}
+	close(s.done)
+	s.mu.Unlock()
+
+	// The leases expired with the session already; this tells their watchers
+	// and waiters.
+	for _, lease := range leases {
+		lease.mu.Lock()
+		if lease.session == s {
+			now := lease.now()
+			if revoke {
+				lease.release(now)
+			} else {
+				lease.settle(now)
+			}
+		}
+		lease.mu.Unlock()
+	}
+}
+
+// deadline returns the time at which the leases held through the session
+// expire.
+func (s *Session) deadline() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.ended {
+		return time.Time{}
+	}
+	return s.expiration
+}
+
+func (s *Session) detach(lease *ThreadSafeLease) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.leases, lease)
+}
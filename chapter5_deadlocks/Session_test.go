@@ -0,0 +1,219 @@
+package chapter5_deadlocks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestSessionKeepsLeasesAlive(t *testing.T) {
+	clock := NewManualClock(time.Unix(0, 0))
+	session := newTestSession(t, 3*time.Second, clock)
+	defer session.Close()
+	leases, _ := acquireThroughSession(t, session, 3)
+
+	for i := 0; i < 10; i++ {
+		clock.Advance(time.Second)
+		waitForKeepAlive(t, session)
+	}
+
+	for i, lease := range leases {
+		if !lease.IsHeld() {
+			t.Fatalf("lease %d expired although the session was kept alive", i)
+		}
+		if remaining := lease.RemainingTTL(); remaining != 3*time.Second {
+			t.Fatalf("RemainingTTL() of lease %d = %v, want the session's 3s", i, remaining)
+		}
+	}
+	select {
+	case <-session.Done():
+		t.Fatalf("Done() closed while the session was kept alive")
+	default:
+	}
+}
+
+func TestSessionMissedKeepAliveExpiresLeases(t *testing.T) {
+	clock := NewManualClock(time.Unix(0, 0))
+	session := newTestSession(t, 3*time.Second, clock)
+	defer session.Close()
+	leases, tokens := acquireThroughSession(t, session, 3)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := leases[0].Watch(ctx)
+
+	// The process stalls for the whole TTL, so the keep-alive comes too late.
+	clock.Advance(3 * time.Second)
+	select {
+	case <-session.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Done() not closed after the session missed its keep-alive")
+	}
+	expectEvent(t, events, LeaseExpired, "holder-0", tokens[0])
+
+	for i, lease := range leases {
+		if lease.IsHeld() {
+			t.Fatalf("lease %d is held after its session expired", i)
+		}
+		if _, err := lease.Acquire("other"); err != nil {
+			t.Fatalf("Acquire() of lease %d after its session expired: %v", i, err)
+		}
+	}
+	if _, err := session.Acquire(NewThreadSafeLeaseWithClock(time.Minute, clock), "late"); !errors.Is(err, ErrSessionDone) {
+		t.Fatalf("Acquire() through an expired session = %v, want ErrSessionDone", err)
+	}
+}
+
+func TestSessionLeasesExpireTogether(t *testing.T) {
+	clock := NewManualClock(time.Unix(0, 0))
+	session := newTestSession(t, 3*time.Second, clock)
+	defer session.Close()
+	leases, _ := acquireThroughSession(t, session, 100)
+
+	// Whether or not the session noticed yet, every lease agrees on whether
+	// it is held at every instant.
+	for _, advance := range []time.Duration{2999 * time.Millisecond, time.Millisecond} {
+		clock.Advance(advance)
+		held := leases[0].IsHeld()
+		for i, lease := range leases {
+			if lease.IsHeld() != held {
+				t.Fatalf("after %v lease %d has IsHeld() = %v, lease 0 has %v", advance, i, lease.IsHeld(), held)
+			}
+		}
+	}
+	if leases[0].IsHeld() {
+		t.Fatalf("leases are held after the TTL of their session")
+	}
+}
+
+func TestSessionClose(t *testing.T) {
+	clock := NewManualClock(time.Unix(0, 0))
+	session := newTestSession(t, 3*time.Second, clock)
+	leases, tokens := acquireThroughSession(t, session, 2)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := leases[0].Watch(ctx)
+
+	// A waiter gets the lease as soon as the session is closed.
+	acquired := make(chan uint64, 1)
+	go func() {
+		token, err := leases[0].AcquireWait(context.Background(), "waiter")
+		if err != nil {
+			t.Errorf("AcquireWait(): %v", err)
+		}
+		acquired <- token
+	}()
+	waitForWaiters(t, leases[0], 1)
+
+	session.Close()
+	select {
+	case <-session.Done():
+	default:
+		t.Fatalf("Done() not closed after Close()")
+	}
+	token := <-acquired
+	expectEvent(t, events, LeaseReleased, "holder-0", tokens[0])
+	expectEvent(t, events, LeaseAcquired, "waiter", token)
+	if leases[1].IsHeld() {
+		t.Fatalf("lease held by %s after its session was closed", leases[1].Holder())
+	}
+}
+
+func TestSessionLeaseRelease(t *testing.T) {
+	clock := NewManualClock(time.Unix(0, 0))
+	session := newTestSession(t, 3*time.Second, clock)
+	defer session.Close()
+	lease := NewThreadSafeLeaseWithClock(time.Minute, clock)
+
+	token, err := session.Acquire(lease, "Alice")
+	if err != nil {
+		t.Fatalf("Acquire(): %v", err)
+	}
+	if err := lease.Renew("Alice", token, time.Hour); err == nil {
+		t.Fatalf("Renew() of a lease held through a session succeeded")
+	}
+	if err := lease.Release("Alice", token); err != nil {
+		t.Fatalf("Release(): %v", err)
+	}
+
+	// The released lease no longer belongs to the session.
+	token = mustAcquire(t, lease, "Bob")
+	session.Close()
+	if holder := lease.Holder(); holder != "Bob" {
+		t.Fatalf("Holder() after closing Alice's session = %q, want Bob", holder)
+	}
+	if err := lease.Renew("Bob", token, time.Minute); err != nil {
+		t.Fatalf("Renew() by Bob: %v", err)
+	}
+}
+
+func TestSessionRejectsShortTTL(t *testing.T) {
+	for _, ttl := range []time.Duration{-time.Second, 0, 2 * time.Nanosecond} {
+		if _, err := NewSessionWithClock(ttl, NewManualClock(time.Unix(0, 0))); !errors.Is(err, ErrSessionTTL) {
+			t.Fatalf("NewSessionWithClock(%v) = %v, want ErrSessionTTL", ttl, err)
+		}
+	}
+}
+
+func TestSessionRejectsLeaseWithOtherClock(t *testing.T) {
+	clock := NewManualClock(time.Unix(0, 0))
+	session := newTestSession(t, 3*time.Second, clock)
+	defer session.Close()
+
+	for _, lease := range []*ThreadSafeLease{
+		NewThreadSafeLease(time.Minute),
+		NewThreadSafeLeaseWithClock(time.Minute, NewManualClock(time.Unix(0, 0))),
+	} {
+		if _, err := session.Acquire(lease, "holder"); !errors.Is(err, ErrSessionClock) {
+			t.Fatalf("Acquire() of a lease with another clock = %v, want ErrSessionClock", err)
+		}
+		if lease.IsHeld() {
+			t.Fatalf("lease with another clock was acquired")
+		}
+	}
+}
+
+// newTestSession creates a session that is valid for ttl, as told by clock.
+func newTestSession(t *testing.T, ttl time.Duration, clock Clock) *Session {
+	t.Helper()
+
+	session, err := NewSessionWithClock(ttl, clock)
+	if err != nil {
+		t.Fatalf("NewSessionWithClock: %v", err)
+	}
+	return session
+}
+
+// acquireThroughSession acquires n new leases through session as holder-0,
+// holder-1 and so on, and returns them with their tokens.
+func acquireThroughSession(t *testing.T, session *Session, n int) ([]*ThreadSafeLease, []uint64) {
+	t.Helper()
+
+	leases := make([]*ThreadSafeLease, n)
+	tokens := make([]uint64, n)
+	for i := range leases {
+		leases[i] = NewThreadSafeLeaseWithClock(time.Minute, session.clock)
+		token, err := session.Acquire(leases[i], fmt.Sprintf("holder-%d", i))
+		if err != nil {
+			t.Fatalf("Acquire() of lease %d: %v", i, err)
+		}
+		tokens[i] = token
+	}
+	return leases, tokens
+}
+
+// waitForKeepAlive waits until the session was renewed for its whole TTL.
+func waitForKeepAlive(t *testing.T, session *Session) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for session.Remaining() != session.ttl {
+		if time.Now().After(deadline) {
+			t.Fatalf("session was not renewed, Remaining() = %v", session.Remaining())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,106 @@
+package chapter5_deadlocks
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+func ExampleLease() {
+	// Create a new lease with a TTL of 5 seconds on a clock that only moves when told to.
+	clock := NewManualClock(time.Now())
+	lease := NewLeaseWithClock(5*time.Second, clock)
+
+	// Try to acquire the lease as holder "Alice".
+	token, err := lease.Acquire("Alice")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Println("Lease acquired by Alice with token", token)
+
+	// Try to renew the lease as holder "Bob". This should fail because "Bob" is not the current holder.
+	err = lease.Renew("Bob", token, 5*time.Second)
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	// Try to renew the lease as holder "Alice" with the correct token.
+	err = lease.Renew("Alice", token, 5*time.Second)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Println("Lease renewed by Alice")
+
+	// Let the lease expire.
+	clock.Advance(6 * time.Second)
+
+	// Try to renew the lease as holder "Alice". This should fail because the lease has expired.
+	err = lease.Renew("Alice", token, 5*time.Second)
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	// Try to release the lease as holder "Bob". This should fail because "Bob" is not the current holder.
+	err = lease.Release("Bob", token)
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	// Try to release the lease as holder "Alice" with the correct token.
+	err = lease.Release("Alice", token)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Println("Lease released by Alice")
+	// Output:
+	// Lease acquired by Alice with token 1
+	// invalid token or lease has expired
+	// Lease renewed by Alice
+	// invalid token or lease has expired
+	// invalid token or lease has expired
+	// invalid token or lease has expired
+}
+
+func ExampleThreadSafeLease_AcquireWait() {
+	// Create a new lease with a TTL of 5 seconds and watch every change of it.
+	lease := NewThreadSafeLease(5 * time.Second)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := lease.Watch(ctx)
+
+	token, err := lease.Acquire("Alice")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	// Bob waits for the lease while Alice holds it.
+	acquired := make(chan uint64)
+	go func() {
+		token, err := lease.AcquireWait(context.Background(), "Bob")
+		if err != nil {
+			fmt.Println("Bob failed to acquire lease:", err)
+			return
+		}
+		acquired <- token
+	}()
+
+	// Releasing the lease hands it to Bob.
+	if err := lease.Release("Alice", token); err != nil {
+		fmt.Println(err)
+		return
+	}
+	<-acquired
+
+	for i := 0; i < 3; i++ {
+		event := <-events
+		fmt.Printf("lease %s by %s with token %d\n", event.Kind, event.Holder, event.Token)
+	}
+	// Output:
+	// lease acquired by Alice with token 1
+	// lease released by Alice with token 1
+	// lease acquired by Bob with token 2
+}
@@ -0,0 +1,42 @@
+// Package locker defines the interface shared by the lock and lease
+// implementations in this repository, so that code written against an
+// in-process lease can move to Redlock without changes.
+package locker
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrNotHeld is returned when renewing or releasing a lock that has expired,
+// was released already or was taken over by another holder.
+var ErrNotHeld = errors.New("lock is not held")
+
+// Locker acquires a single resource on behalf of a single client. Two
+// Lockers for the same resource exclude each other.
+type Locker interface {
+	// Acquire waits until the resource is free and takes it. It returns
+	// ctx.Err() if ctx is done first.
+	Acquire(ctx context.Context) (Lock, error)
+}
+
+// Lock is a held lock. It is valid for a limited time unless renewed.
+type Lock interface {
+	// Token returns the fencing token of the lock. Every acquisition of a
+	// resource is issued a larger token than the ones before it, so the
+	// resource can reject requests from holders whose lock has expired.
+	Token() uint64
+
+	// Remaining returns how much longer the lock is valid, or zero if it
+	// is not valid anymore.
+	Remaining() time.Duration
+
+	// Renew makes the lock valid for ttl from now. It returns an error
+	// wrapping ErrNotHeld if the lock was lost.
+	Renew(ctx context.Context, ttl time.Duration) error
+
+	// Release frees the resource. It returns an error wrapping ErrNotHeld
+	// if the lock was lost.
+	Release(ctx context.Context) error
+}
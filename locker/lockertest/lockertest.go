@@ -0,0 +1,181 @@
+// Package lockertest is a conformance suite for implementations of
+// locker.Locker.
+package lockertest
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/saidatta/DistributedAlgorithms/locker"
+)
+
+// NewResource creates a fresh resource whose locks are valid for ttl and
+// returns a function that creates a new client of it.
+type NewResource func(t *testing.T, ttl time.Duration) func() locker.Locker
+
+// Run runs the conformance suite against the backend that newResource
+// creates resources on.
+func Run(t *testing.T, newResource NewResource) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, newResource NewResource)
+	}{
+		{"AcquireRelease", testAcquireRelease},
+		{"MutualExclusion", testMutualExclusion},
+		{"WaitsForRelease", testWaitsForRelease},
+		{"Renew", testRenew},
+		{"Expiry", testExpiry},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			test.test(t, newResource)
+		})
+	}
+}
+
+func testAcquireRelease(t *testing.T, newResource NewResource) {
+	client := newResource(t, time.Minute)()
+
+	first := acquire(t, client)
+	if first.Token() == 0 {
+		t.Fatalf("Token() = 0, want a positive fencing token")
+	}
+	if remaining := first.Remaining(); remaining <= 0 || remaining > time.Minute {
+		t.Fatalf("Remaining() = %v, want at most the 1m TTL", remaining)
+	}
+	release(t, first)
+
+	if err := first.Release(context.Background()); !errors.Is(err, locker.ErrNotHeld) {
+		t.Fatalf("second Release() = %v, want ErrNotHeld", err)
+	}
+	if err := first.Renew(context.Background(), time.Minute); !errors.Is(err, locker.ErrNotHeld) {
+		t.Fatalf("Renew() after Release() = %v, want ErrNotHeld", err)
+	}
+
+	second := acquire(t, client)
+	if second.Token() <= first.Token() {
+		t.Fatalf("second acquisition got token %d, want more than %d", second.Token(), first.Token())
+	}
+	release(t, second)
+}
+
+func testMutualExclusion(t *testing.T, newResource NewResource) {
+	newClient := newResource(t, time.Minute)
+	holder := acquire(t, newClient())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if lock, err := newClient().Acquire(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		if err == nil {
+			lock.Release(context.Background())
+		}
+		t.Fatalf("Acquire() of a held resource = %v, want %v", err, context.DeadlineExceeded)
+	}
+	release(t, holder)
+}
+
+func testWaitsForRelease(t *testing.T, newResource NewResource) {
+	newClient := newResource(t, time.Minute)
+	holder := acquire(t, newClient())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	acquired := make(chan locker.Lock, 1)
+	failed := make(chan error, 1)
+	go func() {
+		lock, err := newClient().Acquire(ctx)
+		if err != nil {
+			failed <- err
+			return
+		}
+		acquired <- lock
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatalf("Acquire() returned while the resource was held")
+	case err := <-failed:
+		t.Fatalf("Acquire(): %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	release(t, holder)
+
+	select {
+	case lock := <-acquired:
+		if lock.Token() <= holder.Token() {
+			t.Fatalf("waiter got token %d, want more than %d", lock.Token(), holder.Token())
+		}
+		release(t, lock)
+	case err := <-failed:
+		t.Fatalf("Acquire() after the release: %v", err)
+	}
+}
+
+func testRenew(t *testing.T, newResource NewResource) {
+	newClient := newResource(t, 100*time.Millisecond)
+	lock := acquire(t, newClient())
+
+	if err := lock.Renew(context.Background(), time.Minute); err != nil {
+		t.Fatalf("Renew(): %v", err)
+	}
+	if remaining := lock.Remaining(); remaining <= 50*time.Second {
+		t.Fatalf("Remaining() after renewing for 1m = %v", remaining)
+	}
+
+	// The renewed lock outlives its original TTL.
+	time.Sleep(150 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if other, err := newClient().Acquire(ctx); err == nil {
+		other.Release(context.Background())
+		t.Fatalf("Acquire() succeeded while a renewed lock is held")
+	}
+	release(t, lock)
+}
+
+func testExpiry(t *testing.T, newResource NewResource) {
+	newClient := newResource(t, 50*time.Millisecond)
+	stale := acquire(t, newClient())
+
+	time.Sleep(100 * time.Millisecond)
+	if remaining := stale.Remaining(); remaining != 0 {
+		t.Fatalf("Remaining() of an expired lock = %v, want 0", remaining)
+	}
+
+	lock := acquire(t, newClient())
+	if lock.Token() <= stale.Token() {
+		t.Fatalf("lock after expiry got token %d, want more than %d", lock.Token(), stale.Token())
+	}
+	if err := stale.Renew(context.Background(), time.Minute); !errors.Is(err, locker.ErrNotHeld) {
+		t.Fatalf("Renew() of an expired lock = %v, want ErrNotHeld", err)
+	}
+	if err := stale.Release(context.Background()); !errors.Is(err, locker.ErrNotHeld) {
+		t.Fatalf("Release() of an expired lock = %v, want ErrNotHeld", err)
+	}
+	release(t, lock)
+}
+
+func acquire(t *testing.T, client locker.Locker) locker.Lock {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	lock, err := client.Acquire(ctx)
+	if err != nil {
+		t.Fatalf("Acquire(): %v", err)
+	}
+	return lock
+}
+
+func release(t *testing.T, lock locker.Lock) {
+	t.Helper()
+
+	if err := lock.Release(context.Background()); err != nil {
+		t.Fatalf("Release(): %v", err)
+	}
+}